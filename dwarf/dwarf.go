@@ -0,0 +1,483 @@
+// Package dwarf encodes the DWARF debug information of a compiled
+// brainfuck program, which debuggers like gdb use to map the machine
+// code back to the brainfuck source.
+//
+// NOTE: http://dwarfstd.org/doc/DWARF4.pdf
+package dwarf
+
+import "encoding/binary"
+
+// Line is a row in the line table, the instructions from Addr up to the
+// address of the next row come from Line and Column in the source.
+type Line struct {
+	Addr uint64
+	// Line number, starting at 1, or 0 for instructions that don't
+	// come from anywhere in the source.
+	Line   int
+	Column int // Column number in bytes, starting at 1.
+}
+
+// Unit is the debug information for a program compiled from a single
+// source file, which is a single compilation unit in DWARF.
+type Unit struct {
+	Name      string // Path of the source file.
+	CompDir   string // Directory Name is relative to.
+	Producer  string // Name of the compiler.
+	LowPC     uint64 // Address of the first instruction.
+	HighPC    uint64 // Address after the last instruction.
+	Lines     []Line // Ordered by address.
+	Variables []Variable
+}
+
+// TypeKind is the kind of a Type.
+type TypeKind int
+
+const (
+	Unsigned TypeKind = iota // An unsigned integer.
+	Array                    // Count elements of Elem.
+	Pointer                  // A pointer to Elem.
+)
+
+// Type is the type of a variable. Types are shared by pointer, each
+// *Type is only added to the debug information once.
+type Type struct {
+	Kind  TypeKind
+	Name  string // Name of an unsigned integer.
+	Size  int    // Size in bytes of an unsigned integer.
+	Elem  *Type  // Type of the elements of an array, or what a pointer points to.
+	Count uint64 // Number of elements in an array.
+}
+
+// Variable is a variable that the debugger can print, eg: the tape.
+type Variable struct {
+	Name string
+	Type *Type
+	// Location is a DWARF expression for where the variable is, eg:
+	// from Addr or Reg.
+	Location []byte
+	// LowPC and HighPC are the addresses of the instructions the
+	// variable is at Location for, it is optimised out everywhere
+	// else. Both are zero if the variable is always at Location.
+	LowPC, HighPC uint64
+}
+
+// Addr returns a location expression for a variable at addr.
+func Addr(addr uint64) []byte {
+	var b buffer
+	b.u8(opAddr)
+	b.u64(addr)
+	return b
+}
+
+// Reg returns a location expression for a variable that is in the
+// register with the DWARF register number reg.
+func Reg(reg int) []byte {
+	return []byte{opReg0 + byte(reg)}
+}
+
+// BReg returns a location expression for a variable at offset bytes
+// from the address in the register with the DWARF register number reg.
+func BReg(reg int, offset int64) []byte {
+	b := buffer{opBreg0 + byte(reg)}
+	b.sleb(offset)
+	return b
+}
+
+// Deref returns a location expression for a variable at the address
+// stored at the location expr.
+func Deref(expr []byte) []byte {
+	return append(expr[:len(expr):len(expr)], opDeref)
+}
+
+// Section is a debug section and its contents.
+type Section struct {
+	Name string
+	Data []byte
+}
+
+// DWARF constants, only the ones needed are defined.
+const (
+	tagArrayType    = 0x01
+	tagPointerType  = 0x0f
+	tagCompileUnit  = 0x11
+	tagSubrangeType = 0x21
+	tagBaseType     = 0x24
+	tagVariable     = 0x34
+
+	childrenNo  = 0x00
+	childrenYes = 0x01
+
+	atLocation = 0x02
+	atName     = 0x03
+	atByteSize = 0x0b
+	atStmtList = 0x10
+	atLowPC    = 0x11
+	atHighPC   = 0x12
+	atLanguage = 0x13
+	atCompDir  = 0x1b
+	atProducer = 0x25
+	atCount    = 0x37
+	atEncoding = 0x3e
+	atType     = 0x49
+
+	formAddr      = 0x01
+	formData2     = 0x05
+	formData8     = 0x07
+	formString    = 0x08
+	formData1     = 0x0b
+	formRef4      = 0x13
+	formSecOffset = 0x17
+	formExprloc   = 0x18
+
+	ateUnsigned = 0x07
+
+	opAddr  = 0x03
+	opDeref = 0x06
+	opReg0  = 0x50
+	opBreg0 = 0x70
+
+	// There isn't a language for brainfuck, assemblers use this one.
+	langMipsAssembler = 0x8001
+)
+
+// Standard and extended opcodes of the line number program.
+const (
+	lnsCopy        = 0x01
+	lnsAdvancePC   = 0x02
+	lnsAdvanceLine = 0x03
+	lnsSetColumn   = 0x05
+
+	lneEndSequence = 0x01
+	lneSetAddress  = 0x02
+)
+
+// Parameters of the special opcodes of the line number program, which
+// advance the address and line and add a row in a single byte. These
+// are the same as the ones gas uses.
+const (
+	lineBase   = -5
+	lineRange  = 14
+	opcodeBase = 13
+)
+
+// Version of DWARF the sections are encoded in.
+const version = 4
+
+// Sections encodes the unit as the .debug_abbrev, .debug_info and
+// .debug_line sections, and the .debug_loc section if any variables are
+// only at their location for some of the instructions.
+func (u *Unit) Sections() []Section {
+	info, loc := u.info()
+	sections := []Section{
+		{Name: ".debug_abbrev", Data: abbrev()},
+		{Name: ".debug_info", Data: info},
+		{Name: ".debug_line", Data: u.lineProgram()},
+	}
+	if len(loc) > 0 {
+		sections = append(sections, Section{Name: ".debug_loc", Data: loc})
+	}
+	return sections
+}
+
+// Abbreviation codes of each kind of entry in .debug_info.
+const (
+	abbrevCompileUnit = iota + 1
+	abbrevBaseType
+	abbrevArrayType
+	abbrevSubrangeType
+	abbrevPointerType
+	abbrevVariable
+	abbrevVariableList // A variable with a location list in .debug_loc.
+)
+
+// abbreviations are the tag, whether there are children and the
+// attributes and their forms of each kind of entry in .debug_info.
+var abbreviations = []struct {
+	code     uint64
+	tag      uint64
+	children byte
+	attrs    [][2]uint64
+}{
+	{abbrevCompileUnit, tagCompileUnit, childrenYes, [][2]uint64{
+		{atProducer, formString},
+		{atLanguage, formData2},
+		{atName, formString},
+		{atCompDir, formString},
+		{atLowPC, formAddr},
+		{atHighPC, formData8},
+		{atStmtList, formSecOffset},
+	}},
+	{abbrevBaseType, tagBaseType, childrenNo, [][2]uint64{
+		{atName, formString},
+		{atEncoding, formData1},
+		{atByteSize, formData1},
+	}},
+	{abbrevArrayType, tagArrayType, childrenYes, [][2]uint64{
+		{atType, formRef4},
+	}},
+	{abbrevSubrangeType, tagSubrangeType, childrenNo, [][2]uint64{
+		{atType, formRef4},
+		{atCount, formData8},
+	}},
+	{abbrevPointerType, tagPointerType, childrenNo, [][2]uint64{
+		{atByteSize, formData1},
+		{atType, formRef4},
+	}},
+	{abbrevVariable, tagVariable, childrenNo, [][2]uint64{
+		{atName, formString},
+		{atType, formRef4},
+		{atLocation, formExprloc},
+	}},
+	{abbrevVariableList, tagVariable, childrenNo, [][2]uint64{
+		{atName, formString},
+		{atType, formRef4},
+		{atLocation, formSecOffset},
+	}},
+}
+
+// abbrev encodes the abbreviations, which describe the attributes of
+// each kind of entry in .debug_info.
+func abbrev() []byte {
+	var b buffer
+	for _, a := range abbreviations {
+		b.uleb(a.code)
+		b.uleb(a.tag)
+		b.u8(a.children)
+		for _, attr := range a.attrs {
+			b.uleb(attr[0])
+			b.uleb(attr[1])
+		}
+		b.uleb(0)
+		b.uleb(0)
+	}
+	b.uleb(0) // End of the abbreviations.
+	return b
+}
+
+// indexType is the type of the index of arrays, which is the name
+// clang uses for it.
+var indexType = &Type{Kind: Unsigned, Name: "__ARRAY_SIZE_TYPE__", Size: 8}
+
+// info encodes the compilation unit, and the location lists of its
+// variables for .debug_loc.
+func (u *Unit) info() ([]byte, []byte) {
+	var b buffer
+	b.u16(version)
+	b.u32(0) // Offset of the abbreviations in .debug_abbrev.
+	b.u8(8)  // Size of an address.
+
+	b.uleb(abbrevCompileUnit)
+	b.str(u.Producer)
+	b.u16(langMipsAssembler)
+	b.str(u.Name)
+	b.str(u.CompDir)
+	b.u64(u.LowPC)
+	b.u64(u.HighPC - u.LowPC) // A length rather than an address with DW_FORM_data8.
+	b.u32(0)                  // Offset of the line number program in .debug_line.
+
+	// References to types are offsets from the start of the unit,
+	// which includes the length before it.
+	types := make(map[*Type]uint32)
+	var addType func(t *Type) uint32
+	addType = func(t *Type) uint32 {
+		if offset, ok := types[t]; ok {
+			return offset
+		}
+		var elem, index uint32
+		switch t.Kind {
+		case Array:
+			elem, index = addType(t.Elem), addType(indexType)
+		case Pointer:
+			elem = addType(t.Elem)
+		}
+		offset := uint32(4 + len(b))
+		switch t.Kind {
+		case Unsigned:
+			b.uleb(abbrevBaseType)
+			b.str(t.Name)
+			b.u8(ateUnsigned)
+			b.u8(byte(t.Size))
+		case Array:
+			b.uleb(abbrevArrayType)
+			b.u32(elem)
+			b.uleb(abbrevSubrangeType)
+			b.u32(index)
+			b.u64(t.Count)
+			b.uleb(0) // End of the children.
+		case Pointer:
+			b.uleb(abbrevPointerType)
+			b.u8(8)
+			b.u32(elem)
+		}
+		types[t] = offset
+		return offset
+	}
+
+	var loc buffer
+	for _, v := range u.Variables {
+		typ := addType(v.Type)
+		if v.LowPC == 0 && v.HighPC == 0 {
+			b.uleb(abbrevVariable)
+			b.str(v.Name)
+			b.u32(typ)
+			b.uleb(uint64(len(v.Location)))
+			b = append(b, v.Location...)
+			continue
+		}
+		b.uleb(abbrevVariableList)
+		b.str(v.Name)
+		b.u32(typ)
+		b.u32(uint32(len(loc)))
+		// The addresses are relative to the start of the unit.
+		loc.u64(v.LowPC - u.LowPC)
+		loc.u64(v.HighPC - u.LowPC)
+		loc.u16(uint16(len(v.Location)))
+		loc = append(loc, v.Location...)
+		loc.u64(0) // End of the list.
+		loc.u64(0)
+	}
+	b.uleb(0) // End of the children of the compile unit.
+	return withLength(b), loc
+}
+
+// lineProgram encodes the line number program, which is run by the
+// debugger to build the line table.
+func (u *Unit) lineProgram() []byte {
+	var header buffer
+	header.u8(1) // Minimum instruction length.
+	header.u8(1) // Maximum operations per instruction, only VLIW uses more than 1.
+	header.u8(1) // Every row is the start of a statement.
+	header.u8(byte(lineBase + 256))
+	header.u8(lineRange)
+	header.u8(opcodeBase)
+	// Number of operands of each standard opcode.
+	header = append(header, 0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1)
+	header.u8(0) // No include directories.
+	header.str(u.Name)
+	header.uleb(0) // Directory, 0 is the compilation directory.
+	header.uleb(0) // Modification time, unknown.
+	header.uleb(0) // Length, unknown.
+	header.u8(0)   // End of the file names.
+
+	var b buffer
+	b.u16(version)
+	b.u32(uint32(len(header)))
+	b = append(b, header...)
+
+	if len(u.Lines) > 0 {
+		// The registers of the state machine start at line 1 and
+		// column 0, the address is set to the first row's.
+		prev := Line{Addr: u.Lines[0].Addr, Line: 1}
+		b.extended(lneSetAddress, 8)
+		b.u64(prev.Addr)
+		for _, row := range u.Lines {
+			if row.Column != prev.Column {
+				b.u8(lnsSetColumn)
+				b.uleb(uint64(row.Column))
+			}
+			b.advance(row.Addr-prev.Addr, row.Line-prev.Line)
+			prev = row
+		}
+		if u.HighPC > prev.Addr {
+			b.u8(lnsAdvancePC)
+			b.uleb(u.HighPC - prev.Addr)
+		}
+		b.extended(lneEndSequence, 0)
+	}
+	return withLength(b)
+}
+
+// advance adds a row to the line table addr bytes and line lines after
+// the last row, using a special opcode if there is one that does it.
+func (b *buffer) advance(addr uint64, line int) {
+	if line >= lineBase && line < lineBase+lineRange {
+		if opcode := uint64(line-lineBase) + lineRange*addr + opcodeBase; opcode <= 255 {
+			b.u8(byte(opcode))
+			return
+		}
+	}
+	if line != 0 {
+		b.u8(lnsAdvanceLine)
+		b.sleb(int64(line))
+	}
+	if addr != 0 {
+		b.u8(lnsAdvancePC)
+		b.uleb(addr)
+	}
+	b.u8(lnsCopy)
+}
+
+// withLength returns b with its length before it, which is how units in
+// .debug_info and .debug_line start.
+func withLength(b buffer) []byte {
+	var length buffer
+	length.u32(uint32(len(b)))
+	return append(length, b...)
+}
+
+// buffer is DWARF encoded data, which is little endian for x86-64.
+type buffer []byte
+
+func (b *buffer) u8(v byte) {
+	*b = append(*b, v)
+}
+
+func (b *buffer) u16(v uint16) {
+	buf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(buf, v)
+	*b = append(*b, buf...)
+}
+
+func (b *buffer) u32(v uint32) {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, v)
+	*b = append(*b, buf...)
+}
+
+func (b *buffer) u64(v uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, v)
+	*b = append(*b, buf...)
+}
+
+// str appends a null terminated string.
+func (b *buffer) str(s string) {
+	*b = append(*b, s...)
+	*b = append(*b, 0)
+}
+
+// uleb appends v in the unsigned LEB128 encoding, 7 bits at a time
+// with the top bit set on every byte except the last.
+func (b *buffer) uleb(v uint64) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			*b = append(*b, c)
+			return
+		}
+		*b = append(*b, c|0x80)
+	}
+}
+
+// sleb appends v in the signed LEB128 encoding, which stops once the
+// rest of the bits are all the same as the sign bit of the last byte.
+func (b *buffer) sleb(v int64) {
+	for {
+		c := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 && c&0x40 == 0 || v == -1 && c&0x40 != 0 {
+			*b = append(*b, c)
+			return
+		}
+		*b = append(*b, c|0x80)
+	}
+}
+
+// extended appends an extended opcode, which has size bytes of operands
+// that have to be appended after it.
+func (b *buffer) extended(opcode byte, size uint64) {
+	b.u8(0)
+	b.uleb(size + 1)
+	b.u8(opcode)
+}
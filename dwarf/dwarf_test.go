@@ -0,0 +1,192 @@
+package dwarf
+
+import (
+	"debug/dwarf"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestLEB128(t *testing.T) {
+	tests := []struct {
+		value    int64
+		uleb     []byte
+		sleb     []byte
+		unsigned bool
+	}{
+		{0, []byte{0x00}, []byte{0x00}, true},
+		{2, []byte{0x02}, []byte{0x02}, true},
+		{63, []byte{0x3f}, []byte{0x3f}, true},
+		{64, []byte{0x40}, []byte{0xc0, 0x00}, true},
+		{127, []byte{0x7f}, []byte{0xff, 0x00}, true},
+		{128, []byte{0x80, 0x01}, []byte{0x80, 0x01}, true},
+		{12857, []byte{0xb9, 0x64}, []byte{0xb9, 0xe4, 0x00}, true},
+		{-1, nil, []byte{0x7f}, false},
+		{-64, nil, []byte{0x40}, false},
+		{-65, nil, []byte{0xbf, 0x7f}, false},
+		{-128, nil, []byte{0x80, 0x7f}, false},
+	}
+
+	for _, tt := range tests {
+		if tt.unsigned {
+			var b buffer
+			b.uleb(uint64(tt.value))
+			if !reflect.DeepEqual([]byte(b), tt.uleb) {
+				t.Errorf("uleb(%d): got %x, expected %x", tt.value, []byte(b), tt.uleb)
+			}
+		}
+		var b buffer
+		b.sleb(tt.value)
+		if !reflect.DeepEqual([]byte(b), tt.sleb) {
+			t.Errorf("sleb(%d): got %x, expected %x", tt.value, []byte(b), tt.sleb)
+		}
+	}
+}
+
+func TestSections(t *testing.T) {
+	cell := &Type{Kind: Unsigned, Name: "uint16_t", Size: 2}
+	tape := &Type{Kind: Array, Elem: cell, Count: 100}
+	unit := &Unit{
+		Name:     "/src/hello.bf",
+		CompDir:  "/src",
+		Producer: "go-brainfunk",
+		LowPC:    0x4000e8,
+		HighPC:   0x401000,
+		Variables: []Variable{
+			{Name: "tape", Type: tape, Location: Addr(0x601008)},
+			{Name: "ptr", Type: &Type{Kind: Pointer, Elem: cell}, Location: Reg(0), LowPC: 0x400100, HighPC: 0x400ff0},
+		},
+		Lines: []Line{
+			{Addr: 0x400100, Line: 1, Column: 1},
+			{Addr: 0x400103, Line: 1, Column: 2},
+			// Too far for a special opcode.
+			{Addr: 0x400200, Line: 3, Column: 1},
+			{Addr: 0x400201, Line: 300, Column: 1},
+			{Addr: 0x400210, Line: 2, Column: 12},
+			{Addr: 0x400ff0, Line: 0, Column: 0},
+		},
+	}
+	sections := make(map[string][]byte)
+	var names []string
+	for _, s := range unit.Sections() {
+		names = append(names, s.Name)
+		sections[s.Name] = s.Data
+	}
+	if expected := []string{".debug_abbrev", ".debug_info", ".debug_line", ".debug_loc"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("unexpected sections %q, expected %q", names, expected)
+	}
+
+	d, err := dwarf.New(sections[".debug_abbrev"], nil, nil, sections[".debug_info"], sections[".debug_line"], nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := d.Reader()
+	cu, err := r.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cu.Tag != dwarf.TagCompileUnit {
+		t.Fatalf("unexpected entry %+v, expected a compile unit", cu)
+	}
+	for _, tt := range []struct {
+		attr  dwarf.Attr
+		value interface{}
+	}{
+		{dwarf.AttrName, unit.Name},
+		{dwarf.AttrCompDir, unit.CompDir},
+		{dwarf.AttrProducer, unit.Producer},
+		{dwarf.AttrLowpc, unit.LowPC},
+	} {
+		if value := cu.Val(tt.attr); value != tt.value {
+			t.Errorf("unexpected %s %v, expected %v", tt.attr, value, tt.value)
+		}
+	}
+	ranges, err := d.Ranges(cu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][2]uint64{{unit.LowPC, unit.HighPC}}; !reflect.DeepEqual(ranges, expected) {
+		t.Errorf("unexpected ranges %#x, expected %#x", ranges, expected)
+	}
+
+	lr, err := d.LineReader(cu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []Line
+	var entry dwarf.LineEntry
+	for {
+		if err := lr.Next(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if entry.File.Name != unit.Name {
+			t.Errorf("unexpected file %q, expected %q", entry.File.Name, unit.Name)
+		}
+		if entry.EndSequence {
+			if entry.Address != unit.HighPC {
+				t.Errorf("sequence ends at %#x, expected %#x", entry.Address, unit.HighPC)
+			}
+			continue
+		}
+		lines = append(lines, Line{Addr: entry.Address, Line: entry.Line, Column: entry.Column})
+	}
+	if !reflect.DeepEqual(lines, unit.Lines) {
+		t.Errorf("unexpected lines %+v, expected %+v", lines, unit.Lines)
+	}
+
+	// The variables are after the types they use.
+	variables := make(map[string]*dwarf.Entry)
+	for {
+		entry, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry == nil {
+			break
+		}
+		if entry.Tag == dwarf.TagVariable {
+			variables[entry.Val(dwarf.AttrName).(string)] = entry
+		}
+	}
+	if len(variables) != 2 {
+		t.Fatalf("unexpected variables %v, expected tape and ptr", variables)
+	}
+
+	// The cells are DW_ATE_unsigned, not DW_ATE_unsigned_char.
+	uint16Type := &dwarf.UintType{BasicType: dwarf.BasicType{CommonType: dwarf.CommonType{ByteSize: 2, Name: "uint16_t"}}}
+	typ, err := d.Type(variables["tape"].Val(dwarf.AttrType).(dwarf.Offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if array, ok := typ.(*dwarf.ArrayType); !ok || array.Count != 100 || !reflect.DeepEqual(array.Type, uint16Type) {
+		t.Errorf("unexpected tape type %v, expected uint16_t[100]", typ)
+	}
+	if location := variables["tape"].Val(dwarf.AttrLocation); !reflect.DeepEqual(location, []byte{opAddr, 0x08, 0x10, 0x60, 0, 0, 0, 0, 0}) {
+		t.Errorf("unexpected tape location %x", location)
+	}
+
+	typ, err = d.Type(variables["ptr"].Val(dwarf.AttrType).(dwarf.Offset))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ptr, ok := typ.(*dwarf.PtrType); !ok || !reflect.DeepEqual(ptr.Type, uint16Type) {
+		t.Errorf("unexpected ptr type %v, expected *uint16_t", typ)
+	}
+	// The location list of ptr has a single range relative to LowPC,
+	// then the end of the list.
+	if offset := variables["ptr"].Val(dwarf.AttrLocation); offset != int64(0) {
+		t.Errorf("unexpected ptr location list offset %v, expected 0", offset)
+	}
+	var loc buffer
+	loc.u64(0x400100 - unit.LowPC)
+	loc.u64(0x400ff0 - unit.LowPC)
+	loc.u16(1)
+	loc.u8(opReg0)
+	loc.u64(0)
+	loc.u64(0)
+	if !reflect.DeepEqual(sections[".debug_loc"], []byte(loc)) {
+		t.Errorf("unexpected .debug_loc %x, expected %x", sections[".debug_loc"], []byte(loc))
+	}
+}
@@ -2,16 +2,35 @@ package elf
 
 import (
 	"encoding/binary"
+	"fmt"
 )
 
 const (
-	virtualStartAddress    uint32 = 0x400000
-	bssVirtualStartAddress uint32 = 0x600000
-	alignment              uint32 = 0x200000
+	virtualStartAddress     uint64 = 0x400000
+	bssVirtualStartAddress  uint64 = 0x600000
+	dataVirtualStartAddress uint64 = 0x800000
+	alignment               uint64 = 0x200000
+	pageSize                uint64 = 0x1000
+
+	// Size of ELF header + 3 * size program header. The size of
+	// the ELF header is always 0x40 bytes, and the size of each
+	// program header is always 0x38 bytes.
+	textOffset uint64 = 0x40 + (3 * 0x38)
 )
 
 type Builder struct {
 	o []byte
+
+	// PIE builds a position independent executable, which the kernel
+	// loads at a random address. Its addresses are relative to where
+	// it is loaded, so the text starts near 0 rather than at
+	// virtualStartAddress, and must only be used relative to the
+	// address of the code using them.
+	PIE bool
+
+	entry    uint64 // Virtual address the program starts at.
+	symbols  []Symbol
+	sections []section // Sections that aren't loaded, added with AddSection.
 }
 
 func NewBuilder() *Builder {
@@ -20,26 +39,121 @@ func NewBuilder() *Builder {
 	}
 }
 
-func (b *Builder) BssStartAddr() uint32 {
-	return bssVirtualStartAddress
+func (b *Builder) BssStartAddr() uint64 {
+	return b.addr(bssVirtualStartAddress)
+}
+
+// DataStartAddr is the virtual address that the start of the data
+// section will be loaded at.
+func (b *Builder) DataStartAddr() uint64 {
+	return b.addr(dataVirtualStartAddress)
+}
+
+// TextStartAddr is the virtual address that the start of the text
+// section will be loaded at.
+func (b *Builder) TextStartAddr() uint64 {
+	return b.addr(virtualStartAddress) + textOffset
+}
+
+// addr returns the virtual address in the executable of one of the
+// fixed addresses, which are relative to where the executable is
+// loaded in a position independent executable.
+func (b *Builder) addr(addr uint64) uint64 {
+	if b.PIE {
+		return addr - virtualStartAddress
+	}
+	return addr
+}
+
+// SetEntry sets the virtual address that the program starts running
+// at, which is the start of the text section by default.
+func (b *Builder) SetEntry(addr uint64) {
+	b.entry = addr
 }
 
 func (b *Builder) WriteBytes(bs ...byte) {
 	b.o = append(b.o, bs...)
 }
 
-func (b *Builder) WriteValue(size int, value uint32) {
-	buf := make([]byte, size)
-	binary.LittleEndian.PutUint32(buf, value)
-	b.WriteBytes(buf...)
+func (b *Builder) WriteValue(size int, value uint64) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, value)
+	b.WriteBytes(buf[:size]...)
 }
 
-func (o *Builder) Build(textSection []byte, bssSize uint32) []byte {
-	textSize := uint32(len(textSection))
-	// Size of ELF header + 2 * size program header. The size of
-	// the ELF header is always 0x40 bytes, and the size of each
-	// program header is always 0x38 bytes.
-	textOffset := uint32(0x40 + (2 * 0x38))
+// putValue puts the lowest size bytes of value at the start of buf.
+func putValue(buf []byte, size int, value uint64) {
+	for i := 0; i < size; i++ {
+		buf[i] = byte(value >> (8 * uint(i)))
+	}
+}
+
+// Build builds the executable. The data segment is dataSize bytes in
+// memory, starting with the bytes of dataSection and zeroed after them,
+// and is left out if dataSize is zero.
+func (o *Builder) Build(textSection []byte, bssSize uint64, dataSection []byte, dataSize uint64) ([]byte, error) {
+	textSize := uint64(len(textSection))
+	textAddr, bssAddr, dataAddr := o.addr(virtualStartAddress), o.BssStartAddr(), o.DataStartAddr()
+
+	// The .bss segment always starts at a fixed address, or a fixed
+	// distance from the text in a position independent executable, so
+	// the addresses of the cells can be encoded directly into the
+	// generated code. The .text segment is mapped from the start of
+	// the file and must end before the .bss segment starts, the .bss
+	// segment itself can be as large as needed since nothing is
+	// mapped after it.
+	if virtualStartAddress+textOffset+textSize > bssVirtualStartAddress {
+		return nil, fmt.Errorf("generated code is %d bytes, which is larger than the maximum of %d bytes", textSize, bssVirtualStartAddress-virtualStartAddress-textOffset)
+	}
+	// The .data segment starts at a fixed address after the .bss
+	// segment in the same way, and can be as large as needed instead.
+	if dataSize > 0 && bssVirtualStartAddress+bssSize > dataVirtualStartAddress {
+		return nil, fmt.Errorf(".bss segment is %d bytes, which is larger than the maximum of %d bytes", bssSize, dataVirtualStartAddress-bssVirtualStartAddress)
+	}
+	// The data is after the text in the file, at an offset that is
+	// the same as its virtual address modulo the page size so that it
+	// can be mapped straight from the file.
+	dataOffset := (textOffset + textSize + pageSize - 1) / pageSize * pageSize
+
+	sections := []section{
+		{}, // The first section is always the null section.
+		{
+			name:   ".text",
+			typ:    shtProgbits,
+			flags:  shfAlloc | shfExecinstr,
+			addr:   textAddr + textOffset,
+			offset: textOffset,
+			size:   textSize,
+			align:  1,
+		},
+		{
+			name:   ".bss",
+			typ:    shtNobits,
+			flags:  shfAlloc | shfWrite,
+			addr:   bssAddr,
+			offset: textOffset + textSize,
+			size:   bssSize,
+			align:  1,
+		},
+	}
+	fileSize := textOffset + textSize
+	if len(dataSection) > 0 {
+		// Only the initialised data is in the .data section, the
+		// rest of the .data segment is zeroed like the .bss segment.
+		sections = append(sections, section{
+			name:   ".data",
+			typ:    shtProgbits,
+			flags:  shfAlloc | shfWrite,
+			addr:   dataAddr,
+			offset: dataOffset,
+			size:   uint64(len(dataSection)),
+			align:  1,
+		})
+		fileSize = dataOffset + uint64(len(dataSection))
+	}
+	sections = append(sections, o.sections...)
+	sections = append(sections, o.symbolSections(sections, len(sections))...)
+	sections, shoff := layoutSections(sections, fileSize)
 
 	// Build ELF Header
 	o.WriteBytes(0x7f, 0x45, 0x4c, 0x46) // ELF magic value
@@ -52,47 +166,80 @@ func (o *Builder) Build(textSection []byte, bssSize uint32) []byte {
 
 	o.WriteBytes(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Unused bytes
 
-	o.WriteBytes(0x02, 0x00)             // Executable type
+	if o.PIE {
+		o.WriteBytes(0x03, 0x00) // Shared object type, which is how position independent executables are loaded
+	} else {
+		o.WriteBytes(0x02, 0x00) // Executable type
+	}
 	o.WriteBytes(0x3e, 0x00)             // x86-64 target architecture
 	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // ELF version
 
 	// 64-bit virtual offsets always start at 0x400000?? https://stackoverflow.com/questions/38549972/why-elf-executables-have-a-fixed-load-address
 	// This seems to be a convention set in the x86_64 system-v abi: https://refspecs.linuxfoundation.org/elf/x86_64-SysV-psABI.pdf P26
-	o.WriteValue(8, virtualStartAddress+textOffset)
+	entry := o.entry
+	if entry == 0 {
+		entry = textAddr + textOffset
+	}
+	o.WriteValue(8, entry)
 
 	o.WriteBytes(0x40, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Offset from file to program header
-	o.WriteBytes(0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00) // Start of section header table
+	o.WriteValue(8, shoff)                                       // Start of section header table
 	o.WriteBytes(0x00, 0x00, 0x00, 0x00)                         // Flags
 	o.WriteBytes(0x40, 0x00)                                     // Size of this header
 	o.WriteBytes(0x38, 0x00)                                     // Size of a program header table entry - This should always be the same for 64-bit
-	o.WriteBytes(0x02, 0x00)                                     // Length of sections: data and text for now
-	o.WriteBytes(0x00, 0x00)                                     // Size of section header, which we aren't using
-	o.WriteBytes(0x00, 0x00)                                     // Number of entries section header
-	o.WriteBytes(0x00, 0x00)                                     // Index of section header table entry
+	o.WriteBytes(0x03, 0x00)                                     // Number of program headers: text, bss and data, with PT_NULL standing in for data when there is none
+	o.WriteValue(2, sectionHeaderSize)                           // Size of a section header table entry
+	o.WriteValue(2, uint64(len(sections)))                       // Number of entries section header
+	o.WriteValue(2, uint64(len(sections)-1))                     // Index of the section header table entry for the section names, which is always last
 
 	// Build Program Header
 	// Text Segment
 	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment. Both data and text segment use this.
-	o.WriteBytes(0x05, 0x00, 0x00, 0x00) // Flags: 0x4 executable, 0x2 write, 0x1 read
+	o.WriteBytes(0x05, 0x00, 0x00, 0x00) // Flags: 0x1 execute, 0x4 read
 	o.WriteValue(8, 0)                   // textOffset)          // Offset from the beginning of the file. These values depend on how big the header and segment sizes are.
-	o.WriteValue(8, virtualStartAddress)
-	o.WriteValue(8, virtualStartAddress) // Physical address, irrelavnt on linux.
-	o.WriteValue(8, textSize)            // Number of bytes in file image of segment, must be larger than or equal to the size of payload in segment. Should be zero for bss data.
-	o.WriteValue(8, textSize)            // Number of bytes in memory image of segment, is not always same size as file image.
+	o.WriteValue(8, textAddr)
+	o.WriteValue(8, textAddr) // Physical address, irrelavnt on linux.
+	// The segment is mapped from the start of the file, so it includes
+	// the headers as well as the text.
+	o.WriteValue(8, textOffset+textSize) // Number of bytes in file image of segment, must be larger than or equal to the size of payload in segment. Should be zero for bss data.
+	o.WriteValue(8, textOffset+textSize) // Number of bytes in memory image of segment, is not always same size as file image.
 	o.WriteValue(8, alignment)
 
 	// Build Program Header
 	// Bss Segment
-	o.WriteBytes(0x01, 0x00, 0x00, 0x00)    // PT_LOAD, loadable segment. Both data and text segment use this.
-	o.WriteBytes(0x07, 0x00, 0x00, 0x00)    // Flags: 0x4 executable, 0x2 write, 0x1 read // TODO: Which flags are which values exactly???
-	o.WriteValue(8, 0)                      // Offset address.
-	o.WriteValue(8, bssVirtualStartAddress) // Virtual address.
-	o.WriteValue(8, bssVirtualStartAddress) // Physical address.
-	o.WriteValue(8, 0)                      // Number of bytes in file image.
-	o.WriteValue(8, bssSize)                // Number of bytes in memory image.
+	o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment. Both data and text segment use this.
+	o.WriteBytes(0x06, 0x00, 0x00, 0x00) // Flags: 0x2 write, 0x4 read. Nothing is run from the bss.
+	o.WriteValue(8, 0)                   // Offset address.
+	o.WriteValue(8, bssAddr)             // Virtual address.
+	o.WriteValue(8, bssAddr)             // Physical address.
+	o.WriteValue(8, 0)                   // Number of bytes in file image.
+	o.WriteValue(8, bssSize)             // Number of bytes in memory image.
 	o.WriteValue(8, alignment)
 
+	// Build Program Header
+	// Data Segment
+	if dataSize > 0 {
+		o.WriteBytes(0x01, 0x00, 0x00, 0x00) // PT_LOAD, loadable segment.
+		o.WriteBytes(0x06, 0x00, 0x00, 0x00) // Flags: 0x2 write, 0x4 read
+		o.WriteValue(8, dataOffset)
+		o.WriteValue(8, dataAddr) // Virtual address.
+		o.WriteValue(8, dataAddr) // Physical address.
+		o.WriteValue(8, uint64(len(dataSection)))
+		o.WriteValue(8, dataSize)
+		o.WriteValue(8, pageSize)
+	} else {
+		// PT_NULL, an unused entry, so that the text is always at the
+		// same offset.
+		o.WriteBytes(make([]byte, 0x38)...)
+	}
+
 	// Output the text segment
 	o.WriteBytes(textSection...)
-	return o.o
+	if len(dataSection) > 0 {
+		o.pad(dataOffset)
+		o.WriteBytes(dataSection...)
+	}
+
+	o.writeSections(sections, shoff)
+	return o.o, nil
 }
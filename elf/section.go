@@ -0,0 +1,110 @@
+package elf
+
+// Section header types.
+const (
+	shtProgbits uint32 = 1 // Contents are in the file.
+	shtSymtab   uint32 = 2 // Symbol table.
+	shtStrtab   uint32 = 3 // String table.
+	shtNobits   uint32 = 8 // Contents aren't in the file, eg: .bss.
+)
+
+// Section header flags.
+const (
+	shfWrite     uint64 = 0x1
+	shfAlloc     uint64 = 0x2 // Loaded into memory.
+	shfExecinstr uint64 = 0x4
+)
+
+// Size of a section header, which is always 0x40 bytes for 64-bit.
+const sectionHeaderSize = 0x40
+
+// section is an entry in the section header table. Sections aren't
+// used to load the executable, the program headers are, but tools like
+// objdump and gdb use them to find what is in the executable.
+type section struct {
+	name       string
+	nameOffset uint32 // Offset of the name in the section name string table.
+	typ        uint32
+	flags      uint64
+	addr       uint64 // Virtual address, for sections that are loaded.
+	offset     uint64 // Offset in the file.
+	size       uint64
+	link       uint32 // Index of a related section.
+	info       uint32
+	align      uint64
+	entsize    uint64 // Size of each entry, for sections that are tables.
+
+	// Contents of sections that aren't loaded, which are written
+	// after the segments.
+	data []byte
+}
+
+// AddSection adds a section with the contents data that isn't loaded
+// into memory, eg: debug information.
+func (b *Builder) AddSection(name string, data []byte) {
+	b.sections = append(b.sections, section{name: name, typ: shtProgbits, align: 1, data: data})
+}
+
+// layoutSections adds the section name string table to the sections,
+// and sets the offsets of the sections that aren't loaded so they
+// start at offset. It returns the sections and the offset of the
+// section header table.
+func layoutSections(sections []section, offset uint64) ([]section, uint64) {
+	sections = append(sections, section{name: ".shstrtab", typ: shtStrtab, align: 1})
+
+	// The first name is the empty name of the null section.
+	shstrtab := []byte{0}
+	for i := range sections {
+		if name := sections[i].name; name != "" {
+			sections[i].nameOffset = uint32(len(shstrtab))
+			shstrtab = append(shstrtab, name...)
+			shstrtab = append(shstrtab, 0)
+		}
+	}
+	sections[len(sections)-1].data = shstrtab
+
+	for i := range sections {
+		s := &sections[i]
+		if s.data == nil {
+			continue
+		}
+		if s.align > 1 {
+			offset = (offset + s.align - 1) / s.align * s.align
+		}
+		s.offset = offset
+		s.size = uint64(len(s.data))
+		offset += s.size
+	}
+	// The section header table is aligned to 8 bytes.
+	return sections, (offset + 7) / 8 * 8
+}
+
+// writeSections writes the contents of the sections that aren't loaded
+// and then the section header table at shoff.
+func (o *Builder) writeSections(sections []section, shoff uint64) {
+	for _, s := range sections {
+		if s.data == nil {
+			continue
+		}
+		o.pad(s.offset)
+		o.WriteBytes(s.data...)
+	}
+	o.pad(shoff)
+	for _, s := range sections {
+		o.WriteValue(4, uint64(s.nameOffset))
+		o.WriteValue(4, uint64(s.typ))
+		o.WriteValue(8, s.flags)
+		o.WriteValue(8, s.addr)
+		o.WriteValue(8, s.offset)
+		o.WriteValue(8, s.size)
+		o.WriteValue(4, uint64(s.link))
+		o.WriteValue(4, uint64(s.info))
+		o.WriteValue(8, s.align)
+		o.WriteValue(8, s.entsize)
+	}
+}
+
+// pad writes zeros until the output is offset bytes long.
+func (o *Builder) pad(offset uint64) {
+	o.WriteBytes(make([]byte, offset-uint64(len(o.o)))...)
+}
@@ -0,0 +1,106 @@
+package elf
+
+// SymbolType is what a symbol refers to.
+type SymbolType byte
+
+const (
+	SymbolLabel    SymbolType = 0 // A position in the code, STT_NOTYPE.
+	SymbolObject   SymbolType = 1 // Data, STT_OBJECT.
+	SymbolFunction SymbolType = 2 // STT_FUNC.
+)
+
+// Symbol is an entry in the symbol table, which names addresses in the
+// executable for debuggers, eg: `break loop_1_start` in gdb.
+type Symbol struct {
+	Name string
+	Type SymbolType
+	// Global symbols are visible outside of the executable, which is
+	// only the entry point _start, the rest are local.
+	Global bool
+	Addr   uint64
+	Size   uint64
+}
+
+// Size of a symbol table entry, which is always 0x18 bytes for 64-bit.
+const symbolSize = 0x18
+
+// Section index of symbols with an absolute address that isn't in a
+// section.
+const shnAbs = 0xfff1
+
+// AddSymbol adds a symbol to the symbol table of the executable.
+func (b *Builder) AddSymbol(sym Symbol) {
+	b.symbols = append(b.symbols, sym)
+}
+
+// symbolSections returns the .symtab and .strtab sections for the
+// symbols, given the sections the symbols are in, or no sections if
+// there aren't any symbols. The .symtab section links to the .strtab
+// section that comes after it, so it has to be added at index symtab.
+func (b *Builder) symbolSections(sections []section, symtab int) []section {
+	if len(b.symbols) == 0 {
+		return nil
+	}
+
+	// Local symbols have to come before global symbols, and the
+	// first symbol is always the null symbol.
+	var symbols []Symbol
+	for _, global := range []bool{false, true} {
+		for _, sym := range b.symbols {
+			if sym.Global == global {
+				symbols = append(symbols, sym)
+			}
+		}
+	}
+	firstGlobal := len(symbols) + 1
+	for i, sym := range symbols {
+		if sym.Global {
+			firstGlobal = i + 1
+			break
+		}
+	}
+
+	strtab := []byte{0}
+	data := make([]byte, symbolSize, symbolSize*(len(symbols)+1))
+	for _, sym := range symbols {
+		name := uint32(len(strtab))
+		strtab = append(strtab, sym.Name...)
+		strtab = append(strtab, 0)
+
+		bind := byte(0) // STB_LOCAL
+		if sym.Global {
+			bind = 1 // STB_GLOBAL
+		}
+		entry := make([]byte, symbolSize)
+		putValue(entry[0:], 4, uint64(name))
+		entry[4] = bind<<4 | byte(sym.Type)
+		entry[5] = 0 // STV_DEFAULT
+		putValue(entry[6:], 2, uint64(sectionIndex(sections, sym.Addr)))
+		putValue(entry[8:], 8, sym.Addr)
+		putValue(entry[16:], 8, sym.Size)
+		data = append(data, entry...)
+	}
+
+	return []section{
+		{
+			name:    ".symtab",
+			typ:     shtSymtab,
+			link:    uint32(symtab + 1),
+			info:    uint32(firstGlobal),
+			align:   8,
+			entsize: symbolSize,
+			data:    data,
+		},
+		{name: ".strtab", typ: shtStrtab, align: 1, data: strtab},
+	}
+}
+
+// sectionIndex returns the index of the loaded section that addr is in.
+func sectionIndex(sections []section, addr uint64) int {
+	for i, s := range sections {
+		if s.flags&shfAlloc != 0 && addr >= s.addr && addr < s.addr+s.size {
+			return i
+		}
+	}
+	return shnAbs
+}
@@ -0,0 +1,24 @@
+package ir
+
+// ClearLoops replaces loops that only add an odd number to the current
+// cell, eg: `[-]` and `[+]`, with a Clear. Adding an odd number always
+// reaches zero eventually because cells wrap around, so these loops
+// always end with the current cell set to zero.
+func ClearLoops(instrs []Instr) []Instr {
+	var cleared []Instr
+	for _, instr := range instrs {
+		if instr.Op == Loop {
+			if isClearLoop(instr) {
+				instr = Instr{Op: Clear, Pos: instr.Pos}
+			} else {
+				instr.Body = ClearLoops(instr.Body)
+			}
+		}
+		cleared = append(cleared, instr)
+	}
+	return cleared
+}
+
+func isClearLoop(loop Instr) bool {
+	return len(loop.Body) == 1 && loop.Body[0].Op == Add && loop.Body[0].N%2 != 0
+}
@@ -0,0 +1,50 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClearLoops(t *testing.T) {
+	tests := []struct {
+		program  string
+		expected []Instr
+	}{
+		{"[-]", []Instr{{Op: Clear, Pos: Pos{0, 1, 1}}}},
+		{"+[+]", []Instr{
+			{Op: Add, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Clear, Pos: Pos{1, 1, 2}},
+		}},
+		{"[---]", []Instr{{Op: Clear, Pos: Pos{0, 1, 1}}}},
+		// Adding an even number may never reach zero.
+		{"[--]", []Instr{
+			{Op: Loop, Pos: Pos{0, 1, 1}, End: Pos{3, 1, 4}, Body: []Instr{
+				{Op: Add, N: -2, Pos: Pos{1, 1, 2}},
+			}},
+		}},
+		{"[>[-]<-]", []Instr{
+			{Op: Loop, Pos: Pos{0, 1, 1}, End: Pos{7, 1, 8}, Body: []Instr{
+				{Op: Move, N: 1, Pos: Pos{1, 1, 2}},
+				{Op: Clear, Pos: Pos{2, 1, 3}},
+				{Op: Move, N: -1, Pos: Pos{5, 1, 6}},
+				{Op: Add, N: -1, Pos: Pos{6, 1, 7}},
+			}},
+		}},
+		{"[-.]", []Instr{
+			{Op: Loop, Pos: Pos{0, 1, 1}, End: Pos{3, 1, 4}, Body: []Instr{
+				{Op: Add, N: -1, Pos: Pos{1, 1, 2}},
+				{Op: Output, Pos: Pos{2, 1, 3}},
+			}},
+		}},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cleared := ClearLoops(Fold(instrs)); !reflect.DeepEqual(cleared, tt.expected) {
+			t.Errorf("%q: unexpected instructions %+v, expected %+v", tt.program, cleared, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package ir
+
+// DeadLoops removes loops that can never be entered because the current
+// cell is always zero when they are reached. That is a loop at the start
+// of the program, where every cell is zero, and a loop straight after
+// another loop, which only ends once the current cell is zero. This is
+// often used for comments, eg: `[this is a comment.]`.
+func DeadLoops(instrs []Instr) []Instr {
+	return deadLoops(instrs, true)
+}
+
+// deadLoops removes the dead loops from instrs, zero is whether the
+// current cell is known to be zero before the first instruction.
+func deadLoops(instrs []Instr, zero bool) []Instr {
+	var live []Instr
+	for _, instr := range instrs {
+		switch instr.Op {
+		case Loop:
+			if zero {
+				continue
+			}
+			// The current cell isn't zero at the start of the body.
+			instr.Body = deadLoops(instr.Body, false)
+			zero = true
+		case Scan:
+			zero = true
+		case Clear:
+			zero = zero || instr.Offset == 0
+		case Add, MulAdd:
+			zero = zero && instr.Offset != 0
+		case Output:
+			// Doesn't change the current cell.
+		default:
+			zero = false
+		}
+		live = append(live, instr)
+	}
+	return live
+}
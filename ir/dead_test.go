@@ -0,0 +1,75 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDeadLoops(t *testing.T) {
+	tests := []struct {
+		program  string
+		expected []Instr
+	}{
+		// At the start of the program every cell is zero.
+		{"[comment.]+", []Instr{{Op: Add, N: 1, Pos: Pos{10, 1, 11}}}},
+		{"[a][b]", nil},
+		{"+[-][.][,]", []Instr{
+			{Op: Add, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Loop, Pos: Pos{1, 1, 2}, End: Pos{3, 1, 4}, Body: []Instr{
+				{Op: Add, N: -1, Pos: Pos{2, 1, 3}},
+			}},
+		}},
+		// Output doesn't change the current cell.
+		{"+[-].[.]", []Instr{
+			{Op: Add, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Loop, Pos: Pos{1, 1, 2}, End: Pos{3, 1, 4}, Body: []Instr{
+				{Op: Add, N: -1, Pos: Pos{2, 1, 3}},
+			}},
+			{Op: Output, Pos: Pos{4, 1, 5}},
+		}},
+		// The current cell isn't zero at the start of a loop body, or
+		// after moving the tape pointer.
+		{"+[[-]][-]>[-]", []Instr{
+			{Op: Add, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Loop, Pos: Pos{1, 1, 2}, End: Pos{5, 1, 6}, Body: []Instr{
+				{Op: Loop, Pos: Pos{2, 1, 3}, End: Pos{4, 1, 5}, Body: []Instr{
+					{Op: Add, N: -1, Pos: Pos{3, 1, 4}},
+				}},
+			}},
+			{Op: Move, N: 1, Pos: Pos{9, 1, 10}},
+			{Op: Loop, Pos: Pos{10, 1, 11}, End: Pos{12, 1, 13}, Body: []Instr{
+				{Op: Add, N: -1, Pos: Pos{11, 1, 12}},
+			}},
+		}},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if live := DeadLoops(instrs); !reflect.DeepEqual(live, tt.expected) {
+			t.Errorf("%q: unexpected instructions %+v, expected %+v", tt.program, live, tt.expected)
+		}
+	}
+}
+
+func TestDeadLoopsAfterPasses(t *testing.T) {
+	// Clears and scans also leave the current cell zero, and changes
+	// to other cells don't change that.
+	program := "+[-][a]+[>]>+<[b]"
+	instrs, err := Parse([]byte(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Instr{
+		{Op: Add, N: 1, Pos: Pos{0, 1, 1}},
+		{Op: Clear, Pos: Pos{1, 1, 2}},
+		{Op: Add, N: 1, Pos: Pos{7, 1, 8}},
+		{Op: Scan, N: 1, Pos: Pos{8, 1, 9}},
+		{Op: Add, N: 1, Offset: 1, Pos: Pos{12, 1, 13}},
+	}
+	if live := DeadLoops(Offsets(ScanLoops(ClearLoops(instrs)))); !reflect.DeepEqual(live, expected) {
+		t.Errorf("unexpected instructions %+v, expected %+v", live, expected)
+	}
+}
@@ -0,0 +1,158 @@
+package ir
+
+// State is the state of a program that has been partly run at compile
+// time.
+type State struct {
+	// Tape is the cells up to the last one that isn't zero, the rest
+	// of the cells are all zero.
+	Tape []uint64
+	// Ptr is the index of the current cell.
+	Ptr int
+	// Output is everything written to stdout.
+	Output []byte
+}
+
+// Evaluate runs as much of the program as it can at compile time,
+// starting with a tape of tapeSize cells that are cellBits wide and all
+// zero. It stops before the first top level instruction that reads
+// input, accesses a cell outside of the tape, or doesn't finish within
+// maxSteps instructions in total, eg: a loop that never ends. It
+// returns the state of the program at that point and the instructions
+// that are left to run from it.
+func Evaluate(instrs []Instr, cellBits int, tapeSize uint64, maxSteps int) (State, []Instr) {
+	e := &evaluator{
+		mask:     1<<uint(cellBits) - 1,
+		tapeSize: tapeSize,
+		steps:    maxSteps,
+	}
+	var left []Instr
+	for i, instr := range instrs {
+		ptr, outputLen := e.Ptr, len(e.Output)
+		e.undo = e.undo[:0]
+		if !e.run(instr) {
+			// The instruction has to be run when the program is,
+			// so undo what was done of it.
+			for j := len(e.undo) - 1; j >= 0; j-- {
+				e.Tape[e.undo[j].index] = e.undo[j].old
+			}
+			e.Ptr, e.Output = ptr, e.Output[:outputLen]
+			left = instrs[i:]
+			break
+		}
+	}
+	for len(e.Tape) > 0 && e.Tape[len(e.Tape)-1] == 0 {
+		e.Tape = e.Tape[:len(e.Tape)-1]
+	}
+	return e.State, left
+}
+
+type evaluator struct {
+	State
+	mask     uint64 // Mask of the bits in a cell.
+	tapeSize uint64
+	steps    int         // Number of instructions left to run.
+	undo     []cellValue // Old values of the cells changed by the current top level instruction.
+}
+
+type cellValue struct {
+	index int
+	old   uint64
+}
+
+// run runs the instruction, and returns false if it can't be run at
+// compile time.
+func (e *evaluator) run(instr Instr) bool {
+	if !e.step() {
+		return false
+	}
+	switch instr.Op {
+	case Add:
+		i, ok := e.index(instr.Offset)
+		if !ok {
+			return false
+		}
+		e.set(i, e.cell(i)+uint64(instr.N))
+	case Move:
+		if _, ok := e.index(instr.N); !ok {
+			return false
+		}
+		e.Ptr += instr.N
+	case Clear:
+		i, ok := e.index(instr.Offset)
+		if !ok {
+			return false
+		}
+		e.set(i, 0)
+	case MulAdd:
+		src, ok := e.index(instr.Src)
+		if !ok {
+			return false
+		}
+		// The cell Offset is never accessed if the cell Src is zero.
+		if e.cell(src) == 0 {
+			break
+		}
+		i, ok := e.index(instr.Offset)
+		if !ok {
+			return false
+		}
+		e.set(i, e.cell(i)+e.cell(src)*uint64(instr.N))
+	case Scan:
+		for e.cell(e.Ptr) != 0 {
+			if _, ok := e.index(instr.N); !ok || !e.step() {
+				return false
+			}
+			e.Ptr += instr.N
+		}
+	case Output:
+		e.Output = append(e.Output, byte(e.cell(e.Ptr)))
+	case Loop:
+		for e.cell(e.Ptr) != 0 {
+			for _, body := range instr.Body {
+				if !e.run(body) {
+					return false
+				}
+			}
+			// Counts as a step itself, so that empty loops end.
+			if !e.step() {
+				return false
+			}
+		}
+	default:
+		// Input can only be read when the program is run.
+		return false
+	}
+	return true
+}
+
+// step uses up one of the steps, and returns false if there are none
+// left.
+func (e *evaluator) step() bool {
+	if e.steps == 0 {
+		return false
+	}
+	e.steps--
+	return true
+}
+
+// index returns the index of the cell offset cells away from the
+// current cell, and false if it is outside of the tape.
+func (e *evaluator) index(offset int) (int, bool) {
+	i := e.Ptr + offset
+	return i, i >= 0 && uint64(i) < e.tapeSize
+}
+
+func (e *evaluator) cell(i int) uint64 {
+	if i < len(e.Tape) {
+		return e.Tape[i]
+	}
+	return 0
+}
+
+func (e *evaluator) set(i int, value uint64) {
+	for len(e.Tape) <= i {
+		e.Tape = append(e.Tape, 0)
+	}
+	e.undo = append(e.undo, cellValue{i, e.Tape[i]})
+	e.Tape[i] = value & e.mask
+}
@@ -0,0 +1,96 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		program  string
+		cellBits int
+		tapeSize uint64
+		expected State
+		left     int // Number of top level instructions left to run.
+	}{
+		{"", 8, 10, State{}, 0},
+		{"++>+++.<-", 8, 10, State{Tape: []uint64{1, 3}, Ptr: 0, Output: []byte{3}}, 0},
+		// Cells wrap around.
+		{"-.", 8, 10, State{Tape: []uint64{255}, Output: []byte{255}}, 0},
+		{"-.", 16, 10, State{Tape: []uint64{65535}, Output: []byte{255}}, 0},
+		{"-", 64, 10, State{Tape: []uint64{1<<64 - 1}}, 0},
+		// 5 * 13 = 65 'A'.
+		{"+++++[>+++++++++++++<-]>.", 8, 10, State{Tape: []uint64{0, 65}, Ptr: 1, Output: []byte("A")}, 0},
+		// Stops before reading input, and everything after it.
+		{"+.>,<.", 8, 10, State{Tape: []uint64{1}, Ptr: 1, Output: []byte{1}}, 3},
+		// The whole loop is run when the program is.
+		{"+.[>+.<,]", 8, 10, State{Tape: []uint64{1}, Output: []byte{1}}, 1},
+		// Moving outside of the tape.
+		{"+.<", 8, 10, State{Tape: []uint64{1}, Output: []byte{1}}, 1},
+		{"+>>>+", 8, 3, State{Tape: []uint64{1}, Ptr: 2}, 2},
+		// Loops that never end.
+		{"+.[]", 8, 10, State{Tape: []uint64{1}, Output: []byte{1}}, 1},
+		{"+[>+<]", 8, 10, State{Tape: []uint64{1}}, 1},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, left := Evaluate(instrs, tt.cellBits, tt.tapeSize, 1000)
+		if !equalStates(state, tt.expected) {
+			t.Errorf("%q: unexpected state %+v, expected %+v", tt.program, state, tt.expected)
+		}
+		if len(left) != tt.left || tt.left > 0 && !reflect.DeepEqual(left, instrs[len(instrs)-tt.left:]) {
+			t.Errorf("%q: unexpected instructions left %+v, expected the last %d", tt.program, left, tt.left)
+		}
+	}
+}
+
+func TestEvaluateAfterPasses(t *testing.T) {
+	// Clears, multiplies, scans and offsets are run the same as the
+	// loops and moves they replaced.
+	program := "+++++[>+++++++++++++<-]>[->+>+<<]>>>>++<<<<+[<]>>-[-]>>>."
+	instrs, err := Parse([]byte(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, left := Evaluate(instrs, 8, 10, 10000)
+	if left != nil {
+		t.Fatalf("unexpected instructions left %+v", left)
+	}
+	for _, pass := range []func([]Instr) []Instr{Fold, ClearLoops, MultiplyLoops, ScanLoops, Offsets} {
+		instrs = pass(instrs)
+	}
+	state, left := Evaluate(instrs, 8, 10, 10000)
+	if left != nil {
+		t.Errorf("unexpected instructions left %+v", left)
+	}
+	if !equalStates(state, expected) {
+		t.Errorf("unexpected state %+v, expected %+v", state, expected)
+	}
+
+	// Multiplying by a zero cell never accesses the other cell, which
+	// is outside of the tape.
+	instrs = MultiplyLoops([]Instr{{Op: Loop, Body: []Instr{
+		{Op: Add, N: -1}, {Op: Move, N: -1}, {Op: Add, N: 1}, {Op: Move, N: 1},
+	}}})
+	if state, left := Evaluate(instrs, 8, 10, 10); left != nil || !equalStates(state, State{}) {
+		t.Errorf("unexpected state %+v and instructions left %+v", state, left)
+	}
+}
+
+// equalStates returns true if the states are the same, treating nil and
+// empty slices the same.
+func equalStates(a, b State) bool {
+	if len(a.Tape) != len(b.Tape) || a.Ptr != b.Ptr || string(a.Output) != string(b.Output) {
+		return false
+	}
+	for i := range a.Tape {
+		if a.Tape[i] != b.Tape[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package ir
+
+// Fold collapses each run of Add instructions into a single Add, and
+// each run of Move instructions into a single Move. Runs that cancel
+// out, eg: `+-` or `><`, are removed.
+func Fold(instrs []Instr) []Instr {
+	return fold(instrs, true)
+}
+
+// FoldAdds is Fold for only the runs of Add instructions. Every Move is
+// kept, so each is still at the position of its own command.
+func FoldAdds(instrs []Instr) []Instr {
+	return fold(instrs, false)
+}
+
+func fold(instrs []Instr, moves bool) []Instr {
+	var folded []Instr
+	for _, instr := range instrs {
+		if instr.Op == Loop {
+			instr.Body = fold(instr.Body, moves)
+			folded = append(folded, instr)
+			continue
+		}
+		if instr.Op != Add && (instr.Op != Move || !moves) {
+			folded = append(folded, instr)
+			continue
+		}
+		if last := len(folded) - 1; last >= 0 && folded[last].Op == instr.Op {
+			folded[last].N += instr.N
+			if folded[last].N == 0 {
+				folded = folded[:last]
+			}
+			continue
+		}
+		folded = append(folded, instr)
+	}
+	return folded
+}
@@ -0,0 +1,65 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	tests := []struct {
+		program  string
+		expected []Instr
+	}{
+		{"+++", []Instr{{Op: Add, N: 3, Pos: Pos{0, 1, 1}}}},
+		{"+-", nil},
+		{"<<<>", []Instr{{Op: Move, N: -2, Pos: Pos{0, 1, 1}}}},
+		{"+ +\n+.+", []Instr{
+			{Op: Add, N: 3, Pos: Pos{0, 1, 1}},
+			{Op: Output, Pos: Pos{5, 2, 2}},
+			{Op: Add, N: 1, Pos: Pos{6, 2, 3}},
+		}},
+		// The moves cancel out, so the adds either side are folded.
+		{"+><+", []Instr{{Op: Add, N: 2, Pos: Pos{0, 1, 1}}}},
+		{"[>>-]>", []Instr{
+			{Op: Loop, Pos: Pos{0, 1, 1}, End: Pos{4, 1, 5}, Body: []Instr{
+				{Op: Move, N: 2, Pos: Pos{1, 1, 2}},
+				{Op: Add, N: -1, Pos: Pos{3, 1, 4}},
+			}},
+			{Op: Move, N: 1, Pos: Pos{5, 1, 6}},
+		}},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		folded := Fold(instrs)
+		if len(folded) == 0 && len(tt.expected) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(folded, tt.expected) {
+			t.Errorf("%q: unexpected instructions %+v, expected %+v", tt.program, folded, tt.expected)
+		}
+	}
+}
+
+func TestFoldAdds(t *testing.T) {
+	instrs, err := Parse([]byte("++>>-[>>]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Instr{
+		{Op: Add, N: 2, Pos: Pos{0, 1, 1}},
+		{Op: Move, N: 1, Pos: Pos{2, 1, 3}},
+		{Op: Move, N: 1, Pos: Pos{3, 1, 4}},
+		{Op: Add, N: -1, Pos: Pos{4, 1, 5}},
+		{Op: Loop, Pos: Pos{5, 1, 6}, End: Pos{8, 1, 9}, Body: []Instr{
+			{Op: Move, N: 1, Pos: Pos{6, 1, 7}},
+			{Op: Move, N: 1, Pos: Pos{7, 1, 8}},
+		}},
+	}
+	if folded := FoldAdds(instrs); !reflect.DeepEqual(folded, expected) {
+		t.Errorf("unexpected instructions %+v, expected %+v", folded, expected)
+	}
+}
@@ -0,0 +1,135 @@
+// Package ir is the intermediate representation of a brainfuck program
+// that sits between parsing the source and generating machine code.
+package ir
+
+import "fmt"
+
+// Op is the operation performed by an instruction.
+type Op int
+
+const (
+	// Add adds N to the cell Offset, N may be negative.
+	Add Op = iota
+	// Move moves the tape pointer by N cells, N may be negative.
+	Move
+	// Output writes the current cell to stdout.
+	Output
+	// Input reads a character from stdin into the current cell.
+	Input
+	// Loop runs Body while the current cell isn't zero.
+	Loop
+
+	// Higher level operations are added after this, they are never
+	// produced by Parse but only by passes that rewrite the program.
+
+	// Clear sets the cell Offset to zero.
+	Clear
+	// MulAdd adds the cell Src multiplied by N to the cell Offset.
+	MulAdd
+	// Scan moves the tape pointer N cells at a time until the current
+	// cell is zero.
+	Scan
+)
+
+var opNames = [...]string{
+	Add:    "add",
+	Move:   "move",
+	Output: "output",
+	Input:  "input",
+	Loop:   "loop",
+	Clear:  "clear",
+	MulAdd: "muladd",
+	Scan:   "scan",
+}
+
+func (op Op) String() string {
+	if int(op) < len(opNames) && opNames[op] != "" {
+		return opNames[op]
+	}
+	return fmt.Sprintf("op(%d)", int(op))
+}
+
+// Pos is a position in the brainfuck source.
+type Pos struct {
+	Offset int // Byte offset, starting at 0.
+	Line   int // Line number, starting at 1.
+	Column int // Column number in bytes, starting at 1.
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Instr is a single instruction. The cell an instruction operates on
+// is the current cell, unless Offset says otherwise.
+type Instr struct {
+	Op     Op
+	N      int
+	Offset int     // Offset in cells from the tape pointer of the cell the instruction changes.
+	Src    int     // Offset in cells from the tape pointer of the cell read, for MulAdd.
+	Body   []Instr // Instructions in the loop, for Loop.
+	Pos    Pos     // Position of the command the instruction came from.
+	End    Pos     // Position of the closing ], for Loop.
+}
+
+// Parse parses a brainfuck program into instructions, one instruction
+// for each command in the program. Anything that isn't a command is a
+// comment and is ignored.
+func Parse(program []byte) ([]Instr, error) {
+	// The instructions of each loop that is still open, the last
+	// one is the innermost loop. The first is the top level.
+	stack := [][]Instr{nil}
+	var loopPos []Pos
+
+	pos := Pos{Line: 1, Column: 1}
+	for i, ch := range program {
+		pos.Offset = i
+		instr := Instr{Pos: pos}
+		// The instruction for a loop is only added at the closing ].
+		add := true
+		switch ch {
+		case '+':
+			instr.Op, instr.N = Add, 1
+		case '-':
+			instr.Op, instr.N = Add, -1
+		case '>':
+			instr.Op, instr.N = Move, 1
+		case '<':
+			instr.Op, instr.N = Move, -1
+		case '.':
+			instr.Op = Output
+		case ',':
+			instr.Op = Input
+		case '[':
+			stack = append(stack, nil)
+			loopPos = append(loopPos, pos)
+			add = false
+		case ']':
+			if len(loopPos) == 0 {
+				return nil, fmt.Errorf("unmatched ] at %s", pos)
+			}
+			instr.Op = Loop
+			instr.Body = stack[len(stack)-1]
+			instr.Pos = loopPos[len(loopPos)-1]
+			instr.End = pos
+			stack = stack[:len(stack)-1]
+			loopPos = loopPos[:len(loopPos)-1]
+		default:
+			add = false
+		}
+		if add {
+			stack[len(stack)-1] = append(stack[len(stack)-1], instr)
+		}
+
+		if ch == '\n' {
+			pos.Line += 1
+			pos.Column = 1
+		} else {
+			pos.Column += 1
+		}
+	}
+	if len(loopPos) > 0 {
+		return nil, fmt.Errorf("unmatched [ at %s", loopPos[len(loopPos)-1])
+	}
+	return stack[0], nil
+}
@@ -0,0 +1,50 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	program := "+-\n> <.\n[,[-]]"
+	expected := []Instr{
+		{Op: Add, N: 1, Pos: Pos{0, 1, 1}},
+		{Op: Add, N: -1, Pos: Pos{1, 1, 2}},
+		{Op: Move, N: 1, Pos: Pos{3, 2, 1}},
+		{Op: Move, N: -1, Pos: Pos{5, 2, 3}},
+		{Op: Output, Pos: Pos{6, 2, 4}},
+		{Op: Loop, Pos: Pos{8, 3, 1}, End: Pos{13, 3, 6}, Body: []Instr{
+			{Op: Input, Pos: Pos{9, 3, 2}},
+			{Op: Loop, Pos: Pos{10, 3, 3}, End: Pos{12, 3, 5}, Body: []Instr{
+				{Op: Add, N: -1, Pos: Pos{11, 3, 4}},
+			}},
+		}},
+	}
+
+	instrs, err := Parse([]byte(program))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(instrs, expected) {
+		t.Errorf("unexpected instructions %+v, expected %+v", instrs, expected)
+	}
+}
+
+func TestParseUnmatched(t *testing.T) {
+	tests := []struct {
+		program string
+		err     string
+	}{
+		{"+[", "unmatched [ at 1:2"},
+		{"[\n[]", "unmatched [ at 1:1"},
+		{"+]", "unmatched ] at 1:2"},
+		{"[]\n]", "unmatched ] at 2:1"},
+	}
+
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.program))
+		if err == nil || err.Error() != tt.err {
+			t.Errorf("%q: unexpected error %v, expected %q", tt.program, err, tt.err)
+		}
+	}
+}
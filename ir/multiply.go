@@ -0,0 +1,73 @@
+package ir
+
+import "math"
+
+// MultiplyLoops replaces multiply loops with straight-line code. A
+// multiply loop only adds to cells and moves the tape pointer, ends
+// up back at the cell it started at, and subtracts 1 from that cell
+// each time round, eg: `[->+>++<<]`. The loop runs as many times as
+// the starting value of the cell, so it adds the cell multiplied by
+// what each iteration adds to every other cell, and then leaves the
+// cell as zero:
+//
+//	[->+>++<<]  becomes  cell[1] += cell[0]*1
+//	                     cell[2] += cell[0]*2
+//	                     cell[0] = 0
+func MultiplyLoops(instrs []Instr) []Instr {
+	var replaced []Instr
+	for _, instr := range instrs {
+		if instr.Op != Loop {
+			replaced = append(replaced, instr)
+			continue
+		}
+		mulAdds, ok := multiplyLoop(instr)
+		if !ok {
+			instr.Body = MultiplyLoops(instr.Body)
+			replaced = append(replaced, instr)
+			continue
+		}
+		replaced = append(replaced, mulAdds...)
+		replaced = append(replaced, Instr{Op: Clear, Pos: instr.Pos})
+	}
+	return replaced
+}
+
+// multiplyLoop returns the MulAdds that replace the loop, if it is a
+// multiply loop.
+func multiplyLoop(loop Instr) ([]Instr, bool) {
+	offset := 0
+	// The amount added to each cell, in the order the cells are
+	// first added to.
+	var offsets []int
+	added := make(map[int]int)
+	for _, instr := range loop.Body {
+		switch instr.Op {
+		case Add:
+			if _, ok := added[offset]; !ok {
+				offsets = append(offsets, offset)
+			}
+			added[offset] += instr.N
+		case Move:
+			offset += instr.N
+		default:
+			return nil, false
+		}
+	}
+	if offset != 0 || added[0] != -1 {
+		return nil, false
+	}
+
+	var mulAdds []Instr
+	for _, o := range offsets {
+		n := added[o]
+		if o == 0 || n == 0 {
+			continue
+		}
+		// The multiplier has to fit in the immediate of an imul.
+		if n < math.MinInt32 || n > math.MaxInt32 {
+			return nil, false
+		}
+		mulAdds = append(mulAdds, Instr{Op: MulAdd, N: n, Offset: o, Pos: loop.Pos})
+	}
+	return mulAdds, true
+}
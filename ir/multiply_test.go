@@ -0,0 +1,66 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMultiplyLoops(t *testing.T) {
+	tests := []struct {
+		program  string
+		expected []Instr
+	}{
+		{"[->+>++<<]", []Instr{
+			{Op: MulAdd, N: 1, Offset: 1, Pos: Pos{0, 1, 1}},
+			{Op: MulAdd, N: 2, Offset: 2, Pos: Pos{0, 1, 1}},
+			{Op: Clear, Pos: Pos{0, 1, 1}},
+		}},
+		{"[<<--->>-<+>]", []Instr{
+			{Op: MulAdd, N: -3, Offset: -2, Pos: Pos{0, 1, 1}},
+			{Op: MulAdd, N: 1, Offset: -1, Pos: Pos{0, 1, 1}},
+			{Op: Clear, Pos: Pos{0, 1, 1}},
+		}},
+		// Cells that end up with nothing added to them are dropped.
+		{"[>+<->-<]", []Instr{{Op: Clear, Pos: Pos{0, 1, 1}}}},
+		{">[[->+<]<]", []Instr{
+			{Op: Move, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Loop, Pos: Pos{1, 1, 2}, End: Pos{9, 1, 10}, Body: []Instr{
+				{Op: MulAdd, N: 1, Offset: 1, Pos: Pos{2, 1, 3}},
+				{Op: Clear, Pos: Pos{2, 1, 3}},
+				{Op: Move, N: -1, Pos: Pos{8, 1, 9}},
+			}},
+		}},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replaced := MultiplyLoops(Fold(instrs)); !reflect.DeepEqual(replaced, tt.expected) {
+			t.Errorf("%q: unexpected instructions %+v, expected %+v", tt.program, replaced, tt.expected)
+		}
+	}
+}
+
+func TestNotMultiplyLoops(t *testing.T) {
+	for _, program := range []string{
+		"[->+<<]",   // Doesn't end up back at the loop cell.
+		"[-->+<]",   // Subtracts 2 from the loop cell.
+		"[+>+<]",    // Adds 1 to the loop cell.
+		"[->.+<]",   // Has output.
+		"[->[>]<]",  // Has an inner loop.
+		"[->+<,]",   // Has input.
+		"[>+<]",     // Never changes the loop cell.
+		"[->+<-+-]", // Subtracts 2 from the loop cell, over several adds.
+	} {
+		instrs, err := Parse([]byte(program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		folded := Fold(instrs)
+		if replaced := MultiplyLoops(folded); !reflect.DeepEqual(replaced, folded) {
+			t.Errorf("%q: unexpected instructions %+v, expected the loop to be unchanged", program, replaced)
+		}
+	}
+}
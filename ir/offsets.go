@@ -0,0 +1,46 @@
+package ir
+
+// Offsets removes moves of the tape pointer from straight-line code,
+// by instead giving the instructions that change cells the offset of
+// their cell from the tape pointer. The moves are added up and only
+// done before loops, scans, I/O and at the end of the straight-line
+// code, eg: `>+>++<<-` becomes
+//
+//	cell[1] += 1
+//	cell[2] += 2
+//	cell[0] -= 1
+//
+// without moving the tape pointer at all.
+func Offsets(instrs []Instr) []Instr {
+	var replaced []Instr
+	offset := 0
+	var movePos Pos
+	// Moves the tape pointer to where the moves so far left it.
+	commit := func() {
+		if offset != 0 {
+			replaced = append(replaced, Instr{Op: Move, N: offset, Pos: movePos})
+			offset = 0
+		}
+	}
+	for _, instr := range instrs {
+		switch instr.Op {
+		case Move:
+			offset += instr.N
+			movePos = instr.Pos
+			continue
+		case Add, Clear:
+			instr.Offset += offset
+		case MulAdd:
+			instr.Offset += offset
+			instr.Src += offset
+		case Loop:
+			commit()
+			instr.Body = Offsets(instr.Body)
+		default:
+			commit()
+		}
+		replaced = append(replaced, instr)
+	}
+	commit()
+	return replaced
+}
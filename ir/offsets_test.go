@@ -0,0 +1,58 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestOffsets(t *testing.T) {
+	tests := []struct {
+		program  string
+		expected []Instr
+	}{
+		{">+>++<<-", []Instr{
+			{Op: Add, N: 1, Offset: 1, Pos: Pos{1, 1, 2}},
+			{Op: Add, N: 2, Offset: 2, Pos: Pos{3, 1, 4}},
+			{Op: Add, N: -1, Pos: Pos{7, 1, 8}},
+		}},
+		// The move is done at the end, from the position of the last
+		// move.
+		{"<<[-]>+>>", []Instr{
+			{Op: Clear, Offset: -2, Pos: Pos{2, 1, 3}},
+			{Op: Add, N: 1, Offset: -1, Pos: Pos{6, 1, 7}},
+			{Op: Move, N: 1, Pos: Pos{7, 1, 8}},
+		}},
+		{">>[->+<]", []Instr{
+			{Op: MulAdd, N: 1, Src: 2, Offset: 3, Pos: Pos{2, 1, 3}},
+			{Op: Clear, Offset: 2, Pos: Pos{2, 1, 3}},
+			{Op: Move, N: 2, Pos: Pos{0, 1, 1}},
+		}},
+		{">+.>+", []Instr{
+			{Op: Add, N: 1, Offset: 1, Pos: Pos{1, 1, 2}},
+			{Op: Move, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Output, Pos: Pos{2, 1, 3}},
+			{Op: Add, N: 1, Offset: 1, Pos: Pos{4, 1, 5}},
+			{Op: Move, N: 1, Pos: Pos{3, 1, 4}},
+		}},
+		{">[>+<,]>[>]", []Instr{
+			{Op: Move, N: 1, Pos: Pos{0, 1, 1}},
+			{Op: Loop, Pos: Pos{1, 1, 2}, End: Pos{6, 1, 7}, Body: []Instr{
+				{Op: Add, N: 1, Offset: 1, Pos: Pos{3, 1, 4}},
+				{Op: Input, Pos: Pos{5, 1, 6}},
+			}},
+			{Op: Move, N: 1, Pos: Pos{7, 1, 8}},
+			{Op: Scan, N: 1, Pos: Pos{8, 1, 9}},
+		}},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		instrs = ScanLoops(MultiplyLoops(ClearLoops(Fold(instrs))))
+		if replaced := Offsets(instrs); !reflect.DeepEqual(replaced, tt.expected) {
+			t.Errorf("%q: unexpected instructions %+v, expected %+v", tt.program, replaced, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,18 @@
+package ir
+
+// ScanLoops replaces loops that only move the tape pointer, eg: `[>]`
+// and `[<<]`, with a Scan.
+func ScanLoops(instrs []Instr) []Instr {
+	var replaced []Instr
+	for _, instr := range instrs {
+		if instr.Op == Loop {
+			if len(instr.Body) == 1 && instr.Body[0].Op == Move {
+				instr = Instr{Op: Scan, N: instr.Body[0].N, Pos: instr.Pos}
+			} else {
+				instr.Body = ScanLoops(instr.Body)
+			}
+		}
+		replaced = append(replaced, instr)
+	}
+	return replaced
+}
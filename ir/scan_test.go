@@ -0,0 +1,39 @@
+package ir
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScanLoops(t *testing.T) {
+	tests := []struct {
+		program  string
+		expected []Instr
+	}{
+		{"[>]", []Instr{{Op: Scan, N: 1, Pos: Pos{0, 1, 1}}}},
+		{"[<<]", []Instr{{Op: Scan, N: -2, Pos: Pos{0, 1, 1}}}},
+		{"[-[<]>]", []Instr{
+			{Op: Loop, Pos: Pos{0, 1, 1}, End: Pos{6, 1, 7}, Body: []Instr{
+				{Op: Add, N: -1, Pos: Pos{1, 1, 2}},
+				{Op: Scan, N: -1, Pos: Pos{2, 1, 3}},
+				{Op: Move, N: 1, Pos: Pos{5, 1, 6}},
+			}},
+		}},
+		{"[>-]", []Instr{
+			{Op: Loop, Pos: Pos{0, 1, 1}, End: Pos{3, 1, 4}, Body: []Instr{
+				{Op: Move, N: 1, Pos: Pos{1, 1, 2}},
+				{Op: Add, N: -1, Pos: Pos{2, 1, 3}},
+			}},
+		}},
+	}
+
+	for _, tt := range tests {
+		instrs, err := Parse([]byte(tt.program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if replaced := ScanLoops(Fold(instrs)); !reflect.DeepEqual(replaced, tt.expected) {
+			t.Errorf("%q: unexpected instructions %+v, expected %+v", tt.program, replaced, tt.expected)
+		}
+	}
+}
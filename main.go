@@ -8,137 +8,1117 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/vishen/go-brainfunk/dwarf"
+	"github.com/vishen/go-brainfunk/ir"
 	x64e "github.com/vishen/go-brainfunk/x64_encoding"
 )
 
+// EOFBehaviour is what happens to the current cell when `,` is
+// unable to read a character because stdin has reached EOF.
+type EOFBehaviour int
+
+const (
+	EOFKeep     EOFBehaviour = iota // Leave the cell unchanged.
+	EOFZero                         // Set the cell to 0.
+	EOFMinusOne                     // Set the cell to -1.
+)
+
+// ParseEOFBehaviour returns the EOFBehaviour named by s, which is one of
+// the values of the -eof flag: keep, zero or minus1.
+func ParseEOFBehaviour(s string) (EOFBehaviour, error) {
+	switch s {
+	case "keep":
+		return EOFKeep, nil
+	case "zero":
+		return EOFZero, nil
+	case "minus1":
+		return EOFMinusOne, nil
+	}
+	return EOFKeep, fmt.Errorf("unknown eof behaviour %q, expected one of keep, zero or minus1", s)
+}
+
+const (
+	// Size of the buffer that output is collected in before being written to stdout.
+	outputBufferSize = 4096
+	// Number of cells in the tape if not otherwise specified.
+	defaultTapeSize = 65536
+	// Largest tape in bytes, half of the 128TiB of address space that
+	// programs have on x86-64 so there is room for the rest of the
+	// program and the guard pages.
+	maxTapeBytes = 1 << 46
+	// Largest tape in bytes that is put in the .bss or .data segment,
+	// larger tapes are allocated with mmap when the program starts. The
+	// kernel reserves memory for the whole .bss segment when it loads
+	// the executable, and kills the program before it runs if it can't.
+	maxStaticTapeBytes = 1 << 28
+	// Exit status of a program that moved the tape pointer outside of
+	// the tape when compiled with bounds checking or guard pages.
+	tapeOutOfRangeExitCode = 3
+	// Size of a page, which is the granularity of the guard pages.
+	pageSize = 4096
+)
+
+type Options struct {
+	// CellBits is the width of each cell, one of 8, 16, 32 or 64.
+	// Cells wrap around when incremented past their maximum value.
+	// Defaults to 64 when not set.
+	CellBits int
+	// CheckBounds checks the tape pointer is still within the tape
+	// after every move, and exits with an error if it isn't.
+	CheckBounds bool
+	// GuardPages allocates the tape at runtime with inaccessible
+	// pages either side of it, and exits with an error when one of
+	// them is accessed. The tape is rounded up to a whole number of
+	// pages, so only accesses past the rounded up end are caught.
+	// Accesses more than a page outside of the tape miss the guard
+	// pages and aren't caught either.
+	GuardPages bool
+	// GrowTape allocates the tape at runtime, and grows it whenever
+	// the tape pointer moves past the end of it. TapeSize is the
+	// initial size of the tape.
+	GrowTape bool
+	// TapeSize is the number of cells in the tape. Defaults to
+	// defaultTapeSize when not set.
+	TapeSize uint64
+	// EOF is what `,` stores in the cell at end of input, or when
+	// reading from stdin fails.
+	EOF EOFBehaviour
+	// Unbuffered writes each character to stdout as soon as it
+	// is output, rather than collecting them in a buffer.
+	Unbuffered bool
+	// OptLevel is the optimisation level, from 0 (a literal
+	// translation of each command) to maxOptLevel.
+	OptLevel int
+	// DisablePasses are the names of passes that aren't run even
+	// if the optimisation level enables them.
+	DisablePasses []string
+	// Debug adds DWARF debug information to the executable, which
+	// maps the code back to the lines and columns in SourceFile that
+	// it came from so that debuggers like gdb can step through the
+	// brainfuck program.
+	Debug bool
+	// SourceFile is the path of the brainfuck program, which is only
+	// used by the debug information.
+	SourceFile string
+	// PIE emits a position independent executable, which is loaded at
+	// a random address each time it is run. All addresses are
+	// RIP-relative instead of immediates.
+	PIE bool
+}
+
 type Compiler struct {
 	x64 *x64e.Builder
 
+	opts     Options
+	cellSize x64e.Size
+
 	program []byte
 
 	nextLoopNumber     int
-	loopStack          []int
 	loopNumberToOffset map[int]int32
 	loopNumberToAddrID map[int]int
 
 	memoryIndexMax int32
 	outputOffset   int32 // Offset in program where sys_write fuction is.
+	inputOffset    int32 // Offset in program where sys_read fuction is.
+	flushOffset    int32 // Offset in program where the output buffer flush function is.
+	outputBuffer   uint64
+
+	boundsErrorOffset int32 // Offset in program where the tape out of range error function is.
+	segvOffset        int32 // Offset in program where the SIGSEGV handler is.
+	restorerOffset    int32 // Offset in program where the signal handler return function is.
+	allocErrorOffset  int32 // Offset in program where the tape allocation error function is.
+	growOffset        int32 // Offset in program where the grow tape function is.
+	sourceOffset      int   // Offset in the brainfuck program of the command being emitted.
+
+	tapeBytes uint64 // Size of the tape in bytes.
+	tapeStart uint64 // Address the start of the tape is stored at when it is mmapped, except with -grow-tape.
+	tapeAddr  uint64 // Address of the tape when it is in the .bss or .data segment.
+	// Offset in program where the code for the brainfuck program
+	// starts, after the tape has been set up.
+	programOffset int32
+
+	// When cacheCell is set the current cell is kept in cellReg within
+	// straight-line code, and is only stored back to the tape when the
+	// tape pointer moves, at loops and at I/O.
+	cacheCell  bool
+	cellCached bool // cellReg holds the current cell.
+	cellDirty  bool // cellReg has changed since the current cell was stored.
+	cellZero   bool // The current cell is known to be zero.
 }
 
-func NewCompiler(program []byte) *Compiler {
+// cellReg is the register the current cell is kept in.
+const cellReg = x64e.R13
+
+func NewCompiler(program []byte, opts Options) *Compiler {
 	c := &Compiler{
+		opts:               opts,
+		cellSize:           x64e.Qword,
 		program:            program,
 		loopNumberToOffset: make(map[int]int32),
 		loopNumberToAddrID: make(map[int]int),
 		x64:                x64e.NewBuilder(),
+		cacheCell:          passEnabled("cell-register", opts),
+	}
+	if opts.CellBits != 0 {
+		c.cellSize = x64e.Size(opts.CellBits / 8)
+	}
+	c.x64.Peephole = passEnabled("peephole", opts)
+	c.x64.SetPIE(opts.PIE)
+	if opts.Debug {
+		c.x64.Debug = &dwarf.Unit{
+			Name:     opts.SourceFile,
+			CompDir:  filepath.Dir(opts.SourceFile),
+			Producer: "go-brainfunk",
+		}
 	}
 
 	// Some initialisation.
-	// Set up the .bss segment to contain the cells.
-	cells := c.x64.BssAdd(1024 * 64) // [1000]int64
+	// Scratch space for sys_read, only the lowest byte is ever
+	// written to so the rest of the qword is always zero. The
+	// runtime's .bss is reserved before the cells so that its
+	// addresses always fit into a 32-bit immediate.
+	inputChar := c.x64.BssAdd(8)
 
-	c.x64.EmitJmpForwardRelative(23) // Length of stdout function below
+	if c.opts.Unbuffered {
+		c.emitUnbufferedOutput()
+	} else {
+		c.emitBufferedOutput()
+	}
 
-	c.outputOffset = c.x64.CurrentOffset()
-	// Add jump to exit above the write, once the write
-	// has been made into a function that returns
-	c.x64.EmitMovRegReg(x64e.RCX, x64e.RAX)
-	c.x64.EmitMovRegImm(x64e.RAX, 4) // sys_write
-	c.x64.EmitMovRegImm(x64e.RBX, 1) // fd 1: stdout
+	// Reads a single character from stdin into the cell that R14
+	// points to. If nothing was read (EOF or an error) then the
+	// cell is set depending on the EOF behaviour.
+	c.inputOffset = c.x64.CurrentOffset()
+	if !c.opts.Unbuffered {
+		// Anything written so far needs to be visible before
+		// blocking on a read, eg: for prompts.
+		c.x64.EmitCall(c.flushOffset)
+	}
+	c.emitAddr(x64e.RSI, inputChar)
+	c.x64.EmitMovRegImm(x64e.RAX, 0) // sys_read
+	c.x64.EmitMovRegImm(x64e.RDI, 0) // fd 0: stdin
 	c.x64.EmitMovRegImm(x64e.RDX, 1)
-	c.x64.EmitInt(0x80)
+	c.x64.EmitSyscall()
+	if !c.opts.Unbuffered {
+		// The buffer was just flushed, so reset RDI to the start.
+		c.emitAddr(x64e.RDI, c.outputBuffer)
+	}
+	c.x64.EmitCmpRegImm(x64e.RAX, 1) // Number of bytes read.
+	readAddrID := c.x64.EmitJeqNotYetDefined()
+	switch c.opts.EOF {
+	case EOFZero:
+		c.x64.EmitMovRegImm(x64e.RDX, 0)
+		c.x64.EmitMovMemRegSize(c.cellSize, x64e.R14, x64e.RDX, 0)
+	case EOFMinusOne:
+		c.x64.EmitMovRegImm(x64e.RDX, 0xffffffff) // Sign extended to -1.
+		c.x64.EmitMovMemRegSize(c.cellSize, x64e.R14, x64e.RDX, 0)
+	}
+	c.x64.EmitRet()
+	c.x64.CompleteJeq(readAddrID, c.x64.CurrentOffset())
+	c.x64.EmitMovRegMem(x64e.RDX, x64e.RSI, 0)
+	c.x64.EmitMovMemRegSize(c.cellSize, x64e.R14, x64e.RDX, 0)
 	c.x64.EmitRet()
+	c.x64.AddFunction("bf_read", c.inputOffset)
 
-	c.x64.EmitMovRegImm(x64e.RAX, cells) // mov rax, cells ; current position in cells.
-	c.x64.EmitMovRegImm(x64e.R15, 0)     // mov r15, 0 ; this is where the character to be outputted will be.
+	c.tapeBytes = c.tapeSize() * uint64(c.cellSize)
+	if c.opts.GuardPages || c.opts.GrowTape {
+		c.tapeBytes = (c.tapeBytes + pageSize - 1) / pageSize * pageSize
+	}
+	if mmapTape(c.opts) {
+		c.allocErrorOffset = c.emitExitWithMessage("bf_alloc_error", "unable to allocate the tape\n", 1)
+	}
+
+	if c.opts.CheckBounds {
+		c.emitBoundsError()
+	}
+	switch {
+	case c.opts.GuardPages:
+		c.tapeStart = c.emitGuardPageFunctions(c.tapeBytes)
+	case c.opts.GrowTape:
+		c.emitGrowFunction()
+	case mmapTape(c.opts):
+		// Only needed so that debuggers can find the tape.
+		c.tapeStart = c.x64.BssAdd(8)
+	}
 
 	return c
 }
 
-func (c *Compiler) Build() []byte {
-	// Add the exit after the generated code.
+// tapeSize returns the number of cells in the tape.
+func (c *Compiler) tapeSize() uint64 {
+	if c.opts.TapeSize == 0 {
+		return defaultTapeSize
+	}
+	return c.opts.TapeSize
+}
+
+// emitStart emits the start of the program, after the functions, which
+// writes the output of the program so far and sets up the tape in the
+// state the program is in at that point.
+func (c *Compiler) emitStart(state ir.State) {
+	var outputOffset int32
+	if len(state.Output) > 0 {
+		outputOffset = c.x64.EmitBytes("initial_output", state.Output)
+	}
+
+	c.x64.SetEntry(c.x64.CurrentOffset())
+
+	if len(state.Output) > 0 {
+		// Written straight to stdout, there is never anything in the
+		// output buffer before it.
+		c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_write
+		c.x64.EmitMovRegImm(x64e.RDI, 1) // fd 1: stdout
+		c.emitAddr(x64e.RSI, c.x64.TextAddr(outputOffset))
+		c.x64.EmitMovRegImm(x64e.RDX, uint32(len(state.Output)))
+		c.x64.EmitSyscall()
+	}
+
+	switch {
+	case c.opts.GuardPages:
+		c.emitGuardPageTape(c.tapeBytes, c.tapeStart)
+	case c.opts.GrowTape:
+		c.emitMmap(c.tapeBytes, 3) // prot: PROT_READ | PROT_WRITE
+	case mmapTape(c.opts):
+		c.emitMmap(c.tapeBytes, 3) // prot: PROT_READ | PROT_WRITE
+		c.emitAddr(x64e.RCX, c.tapeStart)
+		c.x64.EmitMovMemReg(x64e.RCX, x64e.RAX, 0)
+	case len(state.Tape) > 0:
+		// Set up the .data segment to contain the cells, starting
+		// with the cells that have been set so far.
+		c.tapeAddr = c.x64.DataAdd(c.tapeData(state.Tape), c.tapeBytes)
+		c.x64.AddObject("tape", c.tapeAddr, c.tapeBytes)
+		c.emitAddr(x64e.RAX, c.tapeAddr) // mov rax, cells ; current position in cells.
+	default:
+		// Set up the .bss segment to contain the cells.
+		c.tapeAddr = c.x64.BssAdd(c.tapeBytes)
+		c.x64.AddObject("tape", c.tapeAddr, c.tapeBytes)
+		c.emitAddr(x64e.RAX, c.tapeAddr) // mov rax, cells ; current position in cells.
+	}
+	if c.opts.CheckBounds || c.opts.GrowTape {
+		c.x64.EmitMovRegReg(x64e.RBP, x64e.RAX)      // mov rbp, rax ; first cell.
+		c.x64.EmitMovRegImm64(x64e.R12, c.tapeBytes) // mov r12, tapeBytes
+		c.x64.EmitAddRegReg(x64e.R12, x64e.RAX)      // add r12, rax ; one past the last cell.
+	}
+	for bytes := state.Ptr * int(c.cellSize); bytes > 0; bytes -= maxImm32 {
+		c.x64.EmitAddRegImm(x64e.RAX, uint32(min(bytes, maxImm32)))
+	}
+	if !c.opts.Unbuffered {
+		c.emitAddr(x64e.RDI, c.outputBuffer) // mov rdi, outputBuffer ; next free byte in the output buffer.
+	}
+	c.cellZero = state.Ptr >= len(state.Tape) || state.Tape[state.Ptr] == 0
+	c.programOffset = c.x64.CurrentOffset()
+}
+
+// addDebugVariables adds the tape and the tape pointer to the debug
+// information, so that eg: `print tape[0]@16` and `print *ptr` work in
+// gdb. RAX is only the tape pointer in the code for the brainfuck
+// program, which ends at programEnd.
+func (c *Compiler) addDebugVariables(programEnd int32) {
+	cell := &dwarf.Type{Kind: dwarf.Unsigned, Name: fmt.Sprintf("uint%d_t", c.cellSize*8), Size: int(c.cellSize)}
+	lowPC, highPC := c.x64.TextAddr(c.programOffset), c.x64.TextAddr(programEnd)
+
+	tape := dwarf.Variable{
+		Name: "tape",
+		Type: &dwarf.Type{Kind: dwarf.Array, Elem: cell, Count: c.tapeBytes / uint64(c.cellSize)},
+	}
+	switch {
+	case c.opts.GrowTape:
+		// The tape moves when it grows, but RBP always points to the
+		// start of it. The number of cells is only the initial size.
+		tape.Location = dwarf.BReg(x64e.RBP.DWARFNumber(), 0)
+		tape.LowPC, tape.HighPC = lowPC, highPC
+	case mmapTape(c.opts):
+		tape.Location = dwarf.Deref(dwarf.Addr(c.tapeStart))
+	default:
+		tape.Location = dwarf.Addr(c.tapeAddr)
+	}
+	ptr := dwarf.Variable{
+		Name:     "ptr",
+		Type:     &dwarf.Type{Kind: dwarf.Pointer, Elem: cell},
+		Location: dwarf.Reg(x64e.RAX.DWARFNumber()),
+		LowPC:    lowPC,
+		HighPC:   highPC,
+	}
+	c.x64.Debug.Variables = append(c.x64.Debug.Variables, tape, ptr)
+}
+
+// emitAddr emits code that sets reg to the virtual address addr, which
+// is relative to the instruction in a position independent executable.
+func (c *Compiler) emitAddr(reg x64e.Register, addr uint64) {
+	if c.opts.PIE {
+		c.x64.EmitLeaRegRip(reg, addr)
+	} else {
+		c.x64.EmitMovRegImm(reg, uint32(addr))
+	}
+}
+
+// tapeData returns the bytes of the cells in the tape.
+func (c *Compiler) tapeData(tape []uint64) []byte {
+	data := make([]byte, 0, len(tape)*int(c.cellSize))
+	for _, cell := range tape {
+		for i := 0; i < int(c.cellSize); i++ {
+			data = append(data, byte(cell>>(8*uint(i))))
+		}
+	}
+	return data
+}
+
+// emitExitWithMessage emits a function called name that writes message
+// to stderr and exits with code, and returns the offset of the function.
+func (c *Compiler) emitExitWithMessage(name, message string, code uint32) int32 {
+	messageOffset := c.x64.EmitBytes(name+"_message", []byte(message))
+
+	offset := c.x64.CurrentOffset()
+	c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_write
+	c.x64.EmitMovRegImm(x64e.RDI, 2) // fd 2: stderr
+	c.emitAddr(x64e.RSI, c.x64.TextAddr(messageOffset))
+	c.x64.EmitMovRegImm(x64e.RDX, uint32(len(message)))
+	c.x64.EmitSyscall()
+	c.x64.EmitMovRegImm(x64e.RAX, 60) // sys_exit
+	c.x64.EmitMovRegImm(x64e.RDI, code)
+	c.x64.EmitSyscall()
+	c.x64.AddFunction(name, offset)
+	return offset
+}
+
+// emitGuardPageFunctions emits the SIGSEGV handler used to report
+// accesses to the guard pages either side of a tape of tapeBytes, and
+// returns the address the start of the tape will be stored at.
+func (c *Compiler) emitGuardPageFunctions(tapeBytes uint64) uint64 {
+	tapeStart := c.x64.BssAdd(8)
 
-	c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_exit
-	c.x64.EmitMovRegImm(x64e.RBX, 0) // return code
-	c.x64.EmitInt(0x80)
+	tapeErrorOffset := c.emitExitWithMessage("bf_tape_error", "tape access out of range\n", tapeOutOfRangeExitCode)
+	segvErrorOffset := c.emitExitWithMessage("bf_segv_error", "segmentation fault\n", 128+11)
+
+	// The kernel needs somewhere to return to when the handler
+	// returns, which it never does, but x86-64 requires it anyway.
+	c.restorerOffset = c.x64.CurrentOffset()
+	c.x64.EmitMovRegImm(x64e.RAX, 15) // sys_rt_sigreturn
+	c.x64.EmitSyscall()
+	c.x64.AddFunction("bf_sigreturn", c.restorerOffset)
+
+	// Called with the signal number in RDI, a siginfo_t in RSI and a
+	// ucontext_t in RDX.
+	c.segvOffset = c.x64.CurrentOffset()
+	c.x64.EmitMovRegMem(x64e.RCX, x64e.RSI, 16) // siginfo_t.si_addr, the faulting address.
+	c.emitAddr(x64e.R8, tapeStart)
+	c.x64.EmitMovRegMem(x64e.R8, x64e.R8, 0)
+	c.x64.EmitSubRegReg(x64e.RCX, x64e.R8)
+	c.x64.EmitAddRegImm(x64e.RCX, pageSize)
+	// Anything outside of the tape and its guard pages is an
+	// unrelated segfault.
+	c.x64.EmitMovRegImm64(x64e.R8, tapeBytes+2*pageSize)
+	c.x64.EmitCmpRegReg(x64e.RCX, x64e.R8)
+	tapeAddrID := c.x64.EmitJccNotYetDefined(x64e.CondB)
+	c.x64.EmitCall(segvErrorOffset)
+	c.x64.CompleteJcc(tapeAddrID, c.x64.CurrentOffset())
+	if !c.opts.Unbuffered {
+		// Flush the output buffer using the RDI from when the fault
+		// happened, which is in ucontext_t.uc_mcontext.gregs[REG_RDI].
+		c.x64.EmitMovRegMem(x64e.RDI, x64e.RDX, 40+8*8)
+		c.x64.EmitCall(c.flushOffset)
+	}
+	c.x64.EmitCall(tapeErrorOffset)
+	c.x64.AddFunction("bf_segv_handler", c.segvOffset)
+
+	return tapeStart
+}
+
+// emitMmap emits code that maps size bytes of zeroed memory with the
+// protection prot, leaving the address of the memory in RAX.
+func (c *Compiler) emitMmap(size uint64, prot uint32) {
+	c.x64.EmitMovRegImm(x64e.RAX, 9) // sys_mmap
+	c.x64.EmitMovRegImm(x64e.RDI, 0) // addr: anywhere
+	c.x64.EmitMovRegImm64(x64e.RSI, size)
+	c.x64.EmitMovRegImm(x64e.RDX, prot)
+	c.x64.EmitMovRegImm(x64e.R10, 0x4022)    // flags: MAP_PRIVATE | MAP_ANONYMOUS | MAP_NORESERVE
+	c.x64.EmitMovRegImm(x64e.R8, 0xffffffff) // fd: -1
+	c.x64.EmitMovRegImm(x64e.R9, 0)          // offset
+	c.x64.EmitSyscall()
+	c.emitCheckSyscallAddr()
+}
+
+// emitCheckSyscallAddr emits a check that the address returned in RAX
+// by a syscall isn't an errno, and exits with an error if it is.
+func (c *Compiler) emitCheckSyscallAddr() {
+	c.x64.EmitCmpRegImm(x64e.RAX, 0xfffff001) // Sign extended to -4095, anything above is an errno.
+	okAddrID := c.x64.EmitJccNotYetDefined(x64e.CondB)
+	c.x64.EmitCall(c.allocErrorOffset)
+	c.x64.CompleteJcc(okAddrID, c.x64.CurrentOffset())
+}
+
+// emitGrowFunction emits a function that doubles the size of the tape
+// until the tape pointer is within the tape again. The tape may be
+// moved to a new address, so RAX, RBP and R12 are all updated.
+func (c *Compiler) emitGrowFunction() {
+	c.growOffset = c.x64.CurrentOffset()
+	c.x64.EmitMovRegReg(x64e.R9, x64e.RDI) // RDI is needed for the syscall, but may be the position in the output buffer.
+	c.x64.EmitSubRegReg(x64e.RAX, x64e.RBP)
+	c.x64.EmitMovRegReg(x64e.R14, x64e.RAX) // Position in the tape, which doesn't change.
+	growOffset := c.x64.CurrentOffset()
+	c.x64.EmitMovRegReg(x64e.RDI, x64e.RBP) // old address
+	c.x64.EmitMovRegReg(x64e.RSI, x64e.R12)
+	c.x64.EmitSubRegReg(x64e.RSI, x64e.RBP) // old size
+	c.x64.EmitMovRegReg(x64e.RDX, x64e.RSI)
+	c.x64.EmitAddRegReg(x64e.RDX, x64e.RSI) // new size
+	c.x64.EmitMovRegImm(x64e.R10, 1)        // flags: MREMAP_MAYMOVE
+	c.x64.EmitMovRegImm(x64e.RAX, 25)       // sys_mremap
+	c.x64.EmitSyscall()
+	c.emitCheckSyscallAddr()
+	c.x64.EmitMovRegReg(x64e.RBP, x64e.RAX)
+	c.x64.EmitMovRegReg(x64e.R12, x64e.RAX)
+	c.x64.EmitAddRegReg(x64e.R12, x64e.RDX)
+	c.x64.EmitMovRegReg(x64e.RAX, x64e.R14)
+	c.x64.EmitAddRegReg(x64e.RAX, x64e.RBP)
+	c.x64.EmitCmpRegReg(x64e.RAX, x64e.R12)
+	c.x64.EmitJccBack(x64e.CondAE, growOffset)
+	c.x64.EmitMovRegReg(x64e.RDI, x64e.R9)
+	c.x64.EmitRet()
+	c.x64.AddFunction("bf_grow", c.growOffset)
+}
+
+// emitGuardPageTape emits code that maps a tape of tapeBytes with a
+// guard page either side of it, stores the start of the tape at
+// tapeStart and in RAX, and installs the SIGSEGV handler.
+func (c *Compiler) emitGuardPageTape(tapeBytes, tapeStart uint64) {
+	c.emitMmap(tapeBytes+2*pageSize, 0) // prot: PROT_NONE
+
+	// Make everything except the first and last page accessible.
+	c.x64.EmitMovRegReg(x64e.RDI, x64e.RAX)
+	c.x64.EmitAddRegImm(x64e.RDI, pageSize)
+	c.x64.EmitMovRegImm(x64e.RAX, 10) // sys_mprotect
+	c.x64.EmitMovRegImm64(x64e.RSI, tapeBytes)
+	c.x64.EmitMovRegImm(x64e.RDX, 3) // prot: PROT_READ | PROT_WRITE
+	c.x64.EmitSyscall()
+	c.x64.EmitCmpRegImm(x64e.RAX, 0)
+	mprotectAddrID := c.x64.EmitJeqNotYetDefined()
+	c.x64.EmitCall(c.allocErrorOffset)
+	c.x64.CompleteJeq(mprotectAddrID, c.x64.CurrentOffset())
+	c.emitAddr(x64e.RCX, tapeStart)
+	c.x64.EmitMovMemReg(x64e.RCX, x64e.RDI, 0)
+
+	// Install the SIGSEGV handler, the struct sigaction the kernel
+	// expects is: handler, flags, restorer and the blocked signal mask.
+	sigaction := c.x64.BssAdd(32)
+	c.emitAddr(x64e.RSI, sigaction)
+	c.emitAddr(x64e.RDX, c.x64.TextAddr(c.segvOffset))
+	c.x64.EmitMovMemReg(x64e.RSI, x64e.RDX, 0)
+	c.x64.EmitMovRegImm(x64e.RDX, 0x04000004) // SA_RESTORER | SA_SIGINFO
+	c.x64.EmitMovMemReg(x64e.RSI, x64e.RDX, 8)
+	c.emitAddr(x64e.RDX, c.x64.TextAddr(c.restorerOffset))
+	c.x64.EmitMovMemReg(x64e.RSI, x64e.RDX, 16)
+	c.x64.EmitMovRegReg(x64e.R14, x64e.RDI)
+	c.x64.EmitMovRegImm(x64e.RAX, 13) // sys_rt_sigaction
+	c.x64.EmitMovRegImm(x64e.RDI, 11) // SIGSEGV
+	c.x64.EmitMovRegImm(x64e.RDX, 0)  // old action: not needed
+	c.x64.EmitMovRegImm(x64e.R10, 8)  // size of the signal mask
+	c.x64.EmitSyscall()
+
+	c.x64.EmitMovRegReg(x64e.RAX, x64e.R14) // mov rax, r14 ; current position in cells.
+}
+
+// emitBoundsError emits a function that reports the tape pointer is
+// out of range at the source offset in R15 and exits the program.
+func (c *Compiler) emitBoundsError() {
+	message := c.x64.EmitBytes("bf_bounds_error_message", []byte("tape pointer out of range at source offset "))
+	messageLen := c.x64.CurrentOffset() - message
+	digits := c.x64.BssAdd(24)
+	digitsEnd := digits + 24
+
+	c.boundsErrorOffset = c.x64.CurrentOffset()
+	if !c.opts.Unbuffered {
+		c.x64.EmitCall(c.flushOffset)
+	}
+	c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_write
+	c.x64.EmitMovRegImm(x64e.RDI, 2) // fd 2: stderr
+	c.emitAddr(x64e.RSI, c.x64.TextAddr(message))
+	c.x64.EmitMovRegImm(x64e.RDX, uint32(messageLen))
+	c.x64.EmitSyscall()
+
+	// Convert the source offset to decimal, working backwards from
+	// the end of the digits buffer.
+	c.emitAddr(x64e.RSI, digitsEnd-1)
+	c.x64.EmitMovRegImm(x64e.RDX, '\n')
+	c.x64.EmitMovMemRegSize(x64e.Byte, x64e.RSI, x64e.RDX, 0)
+	c.x64.EmitMovRegReg(x64e.RAX, x64e.R15)
+	c.x64.EmitMovRegImm(x64e.RCX, 10)
+	digitOffset := c.x64.CurrentOffset()
+	c.x64.EmitDecReg(x64e.RSI)
+	c.x64.EmitMovRegImm(x64e.RDX, 0)
+	c.x64.EmitDivReg(x64e.RCX)
+	c.x64.EmitAddRegImm(x64e.RDX, '0')
+	c.x64.EmitMovMemRegSize(x64e.Byte, x64e.RSI, x64e.RDX, 0)
+	c.x64.EmitCmpRegImm(x64e.RAX, 0)
+	c.x64.EmitJneBack(digitOffset)
+
+	c.emitAddr(x64e.RDX, digitsEnd)
+	c.x64.EmitSubRegReg(x64e.RDX, x64e.RSI)
+	c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_write
+	c.x64.EmitMovRegImm(x64e.RDI, 2) // fd 2: stderr
+	c.x64.EmitSyscall()
+
+	c.x64.EmitMovRegImm(x64e.RAX, 60) // sys_exit
+	c.x64.EmitMovRegImm(x64e.RDI, tapeOutOfRangeExitCode)
+	c.x64.EmitSyscall()
+	c.x64.AddFunction("bf_bounds_error", c.boundsErrorOffset)
+}
+
+// emitBoundsCheck emits a check that the tape pointer hasn't moved
+// past the end of the tape (cond == CondB) or before the start of the
+// tape (cond == CondAE). When the tape can grow, moving past the end
+// of the tape grows the tape instead.
+func (c *Compiler) emitBoundsCheck(cond x64e.Condition) {
+	if cond == x64e.CondB {
+		c.x64.EmitCmpRegReg(x64e.RAX, x64e.R12)
+	} else {
+		c.x64.EmitCmpRegReg(x64e.RAX, x64e.RBP)
+	}
+	okAddrID := c.x64.EmitJccNotYetDefined(cond)
+	if cond == x64e.CondB && c.opts.GrowTape {
+		c.x64.EmitCall(c.growOffset)
+	} else {
+		c.x64.EmitMovRegImm(x64e.R15, uint32(c.sourceOffset))
+		c.x64.EmitCall(c.boundsErrorOffset)
+	}
+	c.x64.CompleteJcc(okAddrID, c.x64.CurrentOffset())
+}
+
+// emitUnbufferedOutput emits a function that writes the cell that
+// RAX points to straight to stdout.
+func (c *Compiler) emitUnbufferedOutput() {
+	c.outputOffset = c.x64.CurrentOffset()
+	c.x64.EmitMovRegReg(x64e.RSI, x64e.RAX)
+	c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_write
+	c.x64.EmitMovRegImm(x64e.RDI, 1) // fd 1: stdout
+	c.x64.EmitMovRegImm(x64e.RDX, 1)
+	c.x64.EmitSyscall()
+	c.x64.EmitRet()
+	c.x64.AddFunction("bf_write", c.outputOffset)
+}
+
+// emitBufferedOutput emits a function that appends the cell that RAX
+// points to into the output buffer, and a function to flush the output
+// buffer to stdout. RDI always points to the next free byte in the
+// output buffer.
+func (c *Compiler) emitBufferedOutput() {
+	c.outputBuffer = c.x64.BssAdd(outputBufferSize)
+	c.x64.AddObject("output_buffer", c.outputBuffer, outputBufferSize)
+	outputBufferEnd := c.outputBuffer + outputBufferSize
+
+	c.flushOffset = c.x64.CurrentOffset()
+	c.x64.EmitMovRegReg(x64e.RDX, x64e.RDI)
+	// Number of bytes in the buffer.
+	if c.opts.PIE {
+		c.emitAddr(x64e.RSI, c.outputBuffer)
+		c.x64.EmitSubRegReg(x64e.RDX, x64e.RSI)
+	} else {
+		c.x64.EmitSubRegImm(x64e.RDX, uint32(c.outputBuffer))
+	}
+	emptyAddrID := c.x64.EmitJeqNotYetDefined()
+	c.emitAddr(x64e.RSI, c.outputBuffer)
+	c.x64.EmitMovRegImm(x64e.RAX, 1) // sys_write
+	c.x64.EmitMovRegImm(x64e.RDI, 1) // fd 1: stdout
+	c.x64.EmitSyscall()
+	c.emitAddr(x64e.RDI, c.outputBuffer)
+	c.x64.CompleteJeq(emptyAddrID, c.x64.CurrentOffset())
+	c.x64.EmitRet()
+	c.x64.AddFunction("bf_flush", c.flushOffset)
+
+	c.outputOffset = c.x64.CurrentOffset()
+	c.x64.EmitMovRegMemSize(x64e.Byte, x64e.RAX, x64e.RAX, 0) // Only the lowest byte of the cell is output.
+	c.x64.EmitStosb()                                         // mov byte [rdi], al ; inc rdi
+	if c.opts.PIE {
+		c.emitAddr(x64e.RDX, outputBufferEnd)
+		c.x64.EmitCmpRegReg(x64e.RDI, x64e.RDX)
+	} else {
+		c.x64.EmitCmpRegImm(x64e.RDI, uint32(outputBufferEnd))
+	}
+	fullAddrID := c.x64.EmitJeqNotYetDefined()
+	c.x64.EmitRet()
+	c.x64.CompleteJeq(fullAddrID, c.x64.CurrentOffset())
+	c.x64.EmitCall(c.flushOffset)
+	c.x64.EmitRet()
+	c.x64.AddFunction("bf_write", c.outputOffset)
+}
+
+// checkTapeSize returns an error if the tape is too large to fit in
+// memory, in which case its size in bytes may not fit in a uint64.
+func checkTapeSize(opts Options) error {
+	cellBits := uint64(opts.CellBits)
+	if cellBits == 0 {
+		cellBits = 64
+	}
+	if maxCells := maxTapeBytes / (cellBits / 8); opts.TapeSize > maxCells {
+		return fmt.Errorf("tape size %d is too large for %d-bit cells, expected at most %d cells", opts.TapeSize, cellBits, maxCells)
+	}
+	return nil
+}
+
+// mmapTape returns true if the tape is allocated with mmap when the
+// program starts, rather than being in the .bss or .data segment.
+func mmapTape(opts Options) bool {
+	if opts.GuardPages || opts.GrowTape {
+		return true
+	}
+	cells, cellBits := opts.TapeSize, uint64(opts.CellBits)
+	if cells == 0 {
+		cells = defaultTapeSize
+	}
+	if cellBits == 0 {
+		cellBits = 64
+	}
+	return cells*(cellBits/8) > maxStaticTapeBytes
+}
+
+func (c *Compiler) Build() ([]byte, error) {
+	// Add the exit after the generated code, which isn't any of the
+	// commands in the source.
+	c.x64.SetSourcePos(0, 0)
+	if c.x64.Debug != nil {
+		c.addDebugVariables(c.x64.CurrentOffset())
+	}
+	if !c.opts.Unbuffered {
+		c.x64.EmitCall(c.flushOffset)
+	}
+
+	c.x64.EmitMovRegImm(x64e.RAX, 60) // sys_exit
+	c.x64.EmitMovRegImm(x64e.RDI, 0)  // return code
+	c.x64.EmitSyscall()
 	return c.x64.Build()
 }
 
-func (c *Compiler) EmitInc() {
-	c.x64.EmitIncMem(x64e.RAX, 0)
+// Largest immediate that can be added to a register or qword cell in
+// one instruction, since the 32-bit immediate is sign extended.
+const maxImm32 = 1<<31 - 1
+
+// EmitAdd emits code that adds n to the cell offset cells away from
+// the current cell.
+func (c *Compiler) EmitAdd(n, offset int) {
+	if c.cellSize != x64e.Qword {
+		// Cells wrap around, so only n modulo the size of a cell
+		// matters. Prefer a negative n so that eg: 255 becomes a
+		// dec for 8-bit cells.
+		bits := uint(c.cellSize) * 8
+		n = int(uint64(n) & (1<<bits - 1))
+		if n >= 1<<(bits-1) {
+			n -= 1 << bits
+		}
+	}
+	if c.cacheCell && offset == 0 {
+		c.loadCell()
+		c.cellDirty, c.cellZero = true, false
+		// Only the low bytes of cellReg are the cell, but the
+		// arithmetic is done on just the cell anyway so that the
+		// flags are set from it.
+		switch {
+		case n == 1:
+			c.x64.EmitIncRegSize(c.cellSize, cellReg)
+		case n == -1:
+			c.x64.EmitDecRegSize(c.cellSize, cellReg)
+		case n > 0:
+			for ; n > 0; n -= maxImm32 {
+				c.x64.EmitAddRegImmSize(c.cellSize, cellReg, uint32(min(n, maxImm32)))
+			}
+		case n < 0:
+			for ; n < 0; n += maxImm32 {
+				c.x64.EmitSubRegImmSize(c.cellSize, cellReg, uint32(min(-n, maxImm32)))
+			}
+		}
+		return
+	}
+	c.emitOffsetBoundsCheck(offset)
+	displacement := c.displacement(offset)
+	switch {
+	case n == 1:
+		c.x64.EmitIncMemSize(c.cellSize, x64e.RAX, displacement)
+	case n == -1:
+		c.x64.EmitDecMemSize(c.cellSize, x64e.RAX, displacement)
+	case n > 0:
+		for ; n > 0; n -= maxImm32 {
+			c.x64.EmitAddMemImmSize(c.cellSize, x64e.RAX, displacement, uint32(min(n, maxImm32)))
+		}
+	case n < 0:
+		for ; n < 0; n += maxImm32 {
+			c.x64.EmitSubMemImmSize(c.cellSize, x64e.RAX, displacement, uint32(min(-n, maxImm32)))
+		}
+	}
 }
-func (c *Compiler) EmitDec() {
-	c.x64.EmitDecMem(x64e.RAX, 0)
+
+// EmitMove emits code that moves the tape pointer by n cells.
+func (c *Compiler) EmitMove(n int) {
+	c.spillCell()
+	c.cellZero = false
+	c.memoryIndexMax += int32(n)
+	bytes := n * int(c.cellSize)
+	if bytes > 0 {
+		for ; bytes > 0; bytes -= maxImm32 {
+			c.x64.EmitAddRegImm(x64e.RAX, uint32(min(bytes, maxImm32)))
+		}
+		if c.opts.CheckBounds || c.opts.GrowTape {
+			c.emitBoundsCheck(x64e.CondB)
+		}
+	} else if bytes < 0 {
+		for ; bytes < 0; bytes += maxImm32 {
+			c.x64.EmitSubRegImm(x64e.RAX, uint32(min(-bytes, maxImm32)))
+		}
+		if c.opts.CheckBounds {
+			c.emitBoundsCheck(x64e.CondAE)
+		}
+	}
+}
+
+// EmitClear emits code that sets the cell offset cells away from the
+// current cell to zero.
+func (c *Compiler) EmitClear(offset int) {
+	if c.cacheCell && offset == 0 {
+		c.x64.EmitMovRegImm(cellReg, 0)
+		c.cellCached, c.cellDirty, c.cellZero = true, true, true
+		return
+	}
+	c.emitOffsetBoundsCheck(offset)
+	c.x64.EmitMovMemImmSize(c.cellSize, x64e.RAX, c.displacement(offset), 0)
+}
+
+// EmitMulAdd emits code that adds the cell src cells away from the
+// current cell multiplied by n to the cell offset cells away from it.
+func (c *Compiler) EmitMulAdd(n, src, offset int) {
+	if c.cacheCell && (src == 0 || offset == 0) {
+		// Loaded before the branch below, so that cellReg holds the
+		// current cell whether or not the branch is taken.
+		c.loadCell()
+	}
+
+	// The multiply loop this came from would never have moved to the
+	// other cell if the src cell is zero, so the other cell mustn't be
+	// accessed either, it could be outside of the tape.
+	srcReg := x64e.RDX
+	if c.cacheCell && src == 0 {
+		srcReg = cellReg
+		c.x64.EmitTestRegRegSize(c.cellSize, cellReg, cellReg)
+	} else {
+		c.emitOffsetBoundsCheck(src)
+		c.x64.EmitCmpMemImmSize(c.cellSize, x64e.RAX, c.displacement(src), 0)
+	}
+	zeroAddrID := c.x64.EmitJccNotYetDefined(x64e.CondE)
+	c.emitOffsetBoundsCheck(offset)
+
+	if srcReg == x64e.RDX {
+		c.x64.EmitMovzxRegMemSize(c.cellSize, x64e.RDX, x64e.RAX, c.displacement(src))
+	}
+	if n != 1 && n != -1 {
+		c.x64.EmitImulRegRegImm(x64e.RCX, srcReg, int32(n))
+		srcReg = x64e.RCX
+	}
+	if c.cacheCell && offset == 0 {
+		if n == -1 {
+			c.x64.EmitSubRegReg(cellReg, srcReg)
+		} else {
+			c.x64.EmitAddRegReg(cellReg, srcReg)
+		}
+		c.cellDirty, c.cellZero = true, false
+	} else if n == -1 {
+		c.x64.EmitSubMemRegSize(c.cellSize, x64e.RAX, srcReg, c.displacement(offset))
+	} else {
+		c.x64.EmitAddMemRegSize(c.cellSize, x64e.RAX, srcReg, c.displacement(offset))
+	}
+	c.x64.CompleteJcc(zeroAddrID, c.x64.CurrentOffset())
+}
+
+// loadCell emits code that loads the current cell into cellReg, unless
+// it is already there.
+func (c *Compiler) loadCell() {
+	switch {
+	case c.cellCached:
+	case c.cellZero:
+		c.x64.EmitMovRegImm(cellReg, 0)
+	default:
+		c.x64.EmitMovzxRegMemSize(c.cellSize, cellReg, x64e.RAX, 0)
+	}
+	c.cellCached = true
+}
+
+// storeCell emits code that stores cellReg to the current cell if it
+// has changed.
+func (c *Compiler) storeCell() {
+	if c.cellDirty {
+		c.x64.EmitMovMemRegSize(c.cellSize, x64e.RAX, cellReg, 0)
+		c.cellDirty = false
+	}
+}
+
+// spillCell emits code that stores cellReg to the current cell if it
+// has changed, after which cellReg no longer holds the current cell.
+func (c *Compiler) spillCell() {
+	c.storeCell()
+	c.cellCached = false
+}
+
+// emitCellTest emits code that sets the zero flag if the current cell
+// is zero.
+func (c *Compiler) emitCellTest() {
+	if c.cellCached {
+		c.x64.EmitTestRegRegSize(c.cellSize, cellReg, cellReg)
+	} else {
+		c.x64.EmitCmpMemImmSize(c.cellSize, x64e.RAX, 0, 0)
+	}
+}
+
+// displacement returns the displacement in bytes from the tape pointer
+// of the cell offset cells away from the current cell.
+func (c *Compiler) displacement(offset int) int32 {
+	return int32(offset * int(c.cellSize))
+}
+
+// emitOffsetBoundsCheck emits a check that the cell offset cells away
+// from the current cell is within the tape, when checking bounds or
+// growing the tape.
+func (c *Compiler) emitOffsetBoundsCheck(offset int) {
+	bytes := uint32(offset * int(c.cellSize))
+	if offset > 0 && (c.opts.CheckBounds || c.opts.GrowTape) {
+		c.x64.EmitAddRegImm(x64e.RAX, bytes)
+		c.emitBoundsCheck(x64e.CondB)
+		c.x64.EmitSubRegImm(x64e.RAX, bytes)
+	} else if offset < 0 && c.opts.CheckBounds {
+		c.x64.EmitSubRegImm(x64e.RAX, -bytes)
+		c.emitBoundsCheck(x64e.CondAE)
+		c.x64.EmitAddRegImm(x64e.RAX, -bytes)
+	}
+}
+
+// EmitScan emits code that moves the tape pointer n cells at a time
+// until the current cell is zero.
+func (c *Compiler) EmitScan(n int) {
+	stride := n
+	if stride < 0 {
+		stride = -stride
+	}
+	// The vectorised scan reads whole 16 byte blocks of the tape, so
+	// can't be used when every move has to be checked against the
+	// ends of the tape. The cells it stops at have to be at the same
+	// positions in every block, so the stride has to divide 16.
+	if c.cellSize != x64e.Byte || 16%stride != 0 || c.opts.CheckBounds || c.opts.GrowTape {
+		loopNumber := c.EmitLoop()
+		c.EmitMove(n)
+		c.EmitLoopJump(loopNumber)
+		return
+	}
+	c.spillCell()
+
+	// Compares 16 cells at a time against zero, starting with the
+	// 16 byte aligned block the tape pointer is in. Aligned loads
+	// never cross a page boundary, so they can't fault on a page that
+	// scanning one cell at a time wouldn't have touched.
+	c.x64.EmitMovRegReg(x64e.RCX, x64e.RAX)
+	c.x64.EmitAndRegImm(x64e.RCX, 15)
+	c.x64.EmitSubRegReg(x64e.RAX, x64e.RCX) // RAX is the aligned block, RCX the position in it.
+	if stride > 1 {
+		// R8 has a bit set for each cell the scan can stop at, which
+		// are every stride cells from the tape pointer.
+		var mask uint64
+		for i := 0; i < 64; i += stride {
+			mask |= 1 << uint(i)
+		}
+		c.x64.EmitMovRegImm64(x64e.R8, mask)
+		c.x64.EmitRolRegCl(x64e.R8)
+	}
+	if n < 0 {
+		c.x64.EmitMovRegImm(x64e.RSI, 63)
+		c.x64.EmitSubRegReg(x64e.RSI, x64e.RCX)
+		c.x64.EmitMovRegReg(x64e.RCX, x64e.RSI)
+	}
+	c.x64.EmitPxor(x64e.XMM1, x64e.XMM1)
+	c.emitZeroMask(stride)
+	// Ignore the cells in the first block that are before (or after
+	// when scanning backwards) the tape pointer.
+	if n > 0 {
+		c.x64.EmitShrRegCl(x64e.RDX)
+		c.x64.EmitShlRegCl(x64e.RDX)
+	} else {
+		c.x64.EmitShlRegCl(x64e.RDX)
+		c.x64.EmitShrRegCl(x64e.RDX)
+	}
+	c.x64.EmitTestRegReg(x64e.RDX, x64e.RDX)
+	foundAddrID := c.x64.EmitJccNotYetDefined(x64e.CondNE)
+
+	blockOffset := c.x64.CurrentOffset()
+	if n > 0 {
+		c.x64.EmitAddRegImm(x64e.RAX, 16)
+	} else {
+		c.x64.EmitSubRegImm(x64e.RAX, 16)
+	}
+	c.emitZeroMask(stride)
+	c.x64.EmitTestRegReg(x64e.RDX, x64e.RDX)
+	c.x64.EmitJccBack(x64e.CondE, blockOffset)
+
+	c.x64.CompleteJcc(foundAddrID, c.x64.CurrentOffset())
+	if n > 0 {
+		c.x64.EmitBsfRegReg(x64e.RDX, x64e.RDX)
+	} else {
+		c.x64.EmitBsrRegReg(x64e.RDX, x64e.RDX)
+	}
+	c.x64.EmitAddRegReg(x64e.RAX, x64e.RDX)
+	c.cellZero = true
 }
-func (c *Compiler) EmitNext() {
-	c.x64.EmitAddRegImm(x64e.RAX, 64)
-	c.memoryIndexMax += 1
+
+// emitZeroMask emits code that sets bit i of RDX when the byte at
+// RAX+i is zero, for the 16 bytes at RAX. XMM1 has to be zero. When
+// stride is more than 1 only the bits also set in R8 are kept.
+func (c *Compiler) emitZeroMask(stride int) {
+	c.x64.EmitMovdqaRegMem(x64e.XMM0, x64e.RAX, 0)
+	c.x64.EmitPcmpeqb(x64e.XMM0, x64e.XMM1)
+	c.x64.EmitPmovmskb(x64e.RDX, x64e.XMM0)
+	if stride > 1 {
+		c.x64.EmitAndRegReg(x64e.RDX, x64e.R8)
+	}
 }
-func (c *Compiler) EmitPrev() {
-	c.x64.EmitSubRegImm(x64e.RAX, 64)
-	c.memoryIndexMax -= 1
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
 }
-func (c *Compiler) EmitLoop() {
+
+func (c *Compiler) EmitLoop() int {
 	c.nextLoopNumber += 1
-	c.loopStack = append(c.loopStack, c.nextLoopNumber)
-	c.loopNumberToOffset[c.nextLoopNumber] = c.x64.CurrentOffset()
-	c.x64.EmitCmpMemImm(x64e.RAX, 0)
+	c.storeCell()
+	if c.cacheCell {
+		// The current cell is loaded before both the test here and
+		// the test at the end of the loop, so that it is already in
+		// cellReg at the start of the body.
+		c.loadCell()
+	}
+	c.emitCellTest()
 	addrID := c.x64.EmitJeqNotYetDefined()
 	c.loopNumberToAddrID[c.nextLoopNumber] = addrID
+	// The jump back from the end of the loop has already checked the
+	// current cell, so it jumps straight to the body.
+	c.loopNumberToOffset[c.nextLoopNumber] = c.x64.CurrentOffset()
+	c.x64.AddLabel(fmt.Sprintf("loop_%d_start", c.nextLoopNumber), c.loopNumberToOffset[c.nextLoopNumber])
+	c.cellZero = false
+	return c.nextLoopNumber
 }
-func (c *Compiler) EmitLoopJump() {
-	loopNumber := c.nextLoopNumber
-	for i := len(c.loopStack) - 1; i >= 0; i-- {
-		if c.loopStack[i] == -1 {
-			continue
-		}
-		loopNumber = c.loopStack[i]
-		c.loopStack[i] = -1
-		break
-	}
+func (c *Compiler) EmitLoopJump(loopNumber int) {
 	offset := c.loopNumberToOffset[loopNumber]
-	c.x64.EmitCmpMemImm(x64e.RAX, 0)
-	length := c.x64.EmitJneBack(offset) // TODO: Why is it the length of the jne..?
-	c.x64.CompleteJeq(c.loopNumberToAddrID[loopNumber], c.x64.CurrentOffset(), length)
+	c.storeCell()
+	if c.cacheCell {
+		c.loadCell()
+	}
+	c.emitCellTest()
+	c.x64.EmitJneBack(offset)
+	end := c.x64.CurrentOffset()
+	c.x64.CompleteJeq(c.loopNumberToAddrID[loopNumber], end)
+	c.x64.AddLabel(fmt.Sprintf("loop_%d_end", loopNumber), end)
+	// Either way the loop is left the current cell is zero.
+	c.cellZero = true
 }
 func (c *Compiler) EmitOutputChar() {
+	c.storeCell()
 	c.x64.EmitMovRegReg(x64e.R14, x64e.RAX)
 	c.x64.EmitCall(c.outputOffset)
 	c.x64.EmitMovRegReg(x64e.RAX, x64e.R14)
 }
+func (c *Compiler) EmitInputChar() {
+	c.spillCell()
+	c.cellZero = false
+	c.x64.EmitMovRegReg(x64e.R14, x64e.RAX)
+	c.x64.EmitCall(c.inputOffset)
+	c.x64.EmitMovRegReg(x64e.RAX, x64e.R14)
+}
+
+// Compile compiles the brainfuck program to an executable.
+func Compile(program []byte, opts Options) ([]byte, error) {
+	comp := NewCompiler(program, opts)
+	if err := comp.ParseAndEmit(); err != nil {
+		return nil, err
+	}
+	return comp.Build()
+}
 
+// Maximum number of instructions run when evaluating a program at
+// compile time.
+const evaluateSteps = 1 << 20
+
+// ParseAndEmit parses the brainfuck program and emits the code for it.
 func (c *Compiler) ParseAndEmit() error {
-	loopsCounter := 0
-	loopsFinished := 0
-	for _, ch := range c.program {
-		switch ch {
-		case '+':
-			c.EmitInc()
-		case '-':
-			c.EmitDec()
-		case '>':
-			c.EmitNext()
-		case '<':
-			c.EmitPrev()
-		case '.':
-			c.EmitOutputChar()
-		case '[':
-			loopsCounter += 1
-			c.EmitLoop()
-		case ']':
-			loopsFinished += 1
-			c.EmitLoopJump()
-		}
+	if err := checkTapeSize(c.opts); err != nil {
+		return err
 	}
-	if loopsCounter != loopsFinished {
-		return fmt.Errorf("unbalanced []: %d opened, %d closed\n", loopsCounter, loopsFinished)
+	instrs, err := ir.Parse(c.program)
+	if err != nil {
+		return err
 	}
+	instrs = Optimise(instrs, c.opts)
+	var state ir.State
+	if passEnabled("evaluate", c.opts) {
+		state, instrs = ir.Evaluate(instrs, int(c.cellSize)*8, c.tapeSize(), evaluateSteps)
+		if len(instrs) == 0 {
+			// Nothing is left to run, so the tape isn't needed.
+			state.Tape, state.Ptr = nil, 0
+		}
+	}
+	c.emitStart(state)
+	c.Emit(instrs)
 	return nil
 }
 
+// Emit lowers the instructions to x64 code.
+func (c *Compiler) Emit(instrs []ir.Instr) {
+	for _, instr := range instrs {
+		c.sourceOffset = instr.Pos.Offset
+		c.x64.SetSourcePos(instr.Pos.Line, instr.Pos.Column)
+		switch instr.Op {
+		case ir.Add:
+			c.EmitAdd(instr.N, instr.Offset)
+		case ir.Move:
+			c.EmitMove(instr.N)
+		case ir.Clear:
+			c.EmitClear(instr.Offset)
+		case ir.MulAdd:
+			c.EmitMulAdd(instr.N, instr.Src, instr.Offset)
+		case ir.Scan:
+			c.EmitScan(instr.N)
+		case ir.Output:
+			c.EmitOutputChar()
+		case ir.Input:
+			c.EmitInputChar()
+		case ir.Loop:
+			loopNumber := c.EmitLoop()
+			c.Emit(instr.Body)
+			c.x64.SetSourcePos(instr.End.Line, instr.End.Column)
+			c.EmitLoopJump(loopNumber)
+		default:
+			panic(fmt.Sprintf("unable to emit %s at %s", instr.Op, instr.Pos))
+		}
+	}
+}
+
 var (
 	inputFilename    = flag.String("f", "", "path to bainfuck program to compile")
 	outputBinaryName = flag.String("o", "", "binary executable output name. Defaults to the passed in filename")
+	growTape         = flag.Bool("grow-tape", false, "grow the tape whenever the tape pointer moves past the end of it, -tape-size is the initial size")
+	guardPages       = flag.Bool("guard-pages", false, "allocate the tape with inaccessible guard pages either side of it, and exit with an error when they are accessed")
+	checkBounds      = flag.Bool("check-bounds", false, "exit with an error when the tape pointer moves outside of the tape")
+	tapeSize         = flag.Uint64("tape-size", defaultTapeSize, "number of cells in the tape, tapes larger than 256MiB are allocated when the program starts")
+	cellBits         = flag.Int("cell-bits", 64, "width of each cell in bits: 8, 16, 32 or 64")
+	unbuffered       = flag.Bool("unbuffered", false, "write output as soon as it is produced instead of buffering it, for interactive programs")
+	stats            = flag.Bool("stats", false, "print how many bytes of code each optimisation pass removed, compared with running every other pass but that one")
+	pie              = flag.Bool("pie", false, "emit a position independent executable, which is loaded at a random address")
+	debug            = flag.Bool("g", false, "add debug information so that debuggers like gdb can step through the brainfuck program")
+	eofBehaviour     = flag.String("eof", "keep", "what the , command does to the current cell on EOF: keep, zero or minus1")
+	optLevels        = [maxOptLevel + 1]*bool{
+		flag.Bool("O0", false, "don't optimise, translate each command literally"),
+		flag.Bool("O1", false, "fold runs of commands, replace clear loops and drop loops that are never entered"),
+		flag.Bool("O2", false, "run all optimisation passes, the default"),
+	}
+	disablePasses = func() map[string]*bool {
+		disable := make(map[string]*bool)
+		for _, pass := range passes {
+			disable[pass.Name] = flag.Bool("fno-"+pass.Name, false, fmt.Sprintf("don't run the %s optimisation pass", pass.Name))
+		}
+		return disable
+	}()
 )
 
 func usage() {
@@ -159,6 +1139,47 @@ func main() {
 		log.Fatalf("unable to open file %q: %v", fileToCompile, err)
 	}
 
+	eof, err := ParseEOFBehaviour(*eofBehaviour)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *tapeSize == 0 {
+		log.Fatalf("-tape-size must be at least 1 cell")
+	}
+	if *guardPages && *growTape {
+		log.Fatalf("-guard-pages can't be used with -grow-tape")
+	}
+	switch *cellBits {
+	case 8, 16, 32, 64:
+	default:
+		log.Fatalf("unsupported -cell-bits %d, expected one of 8, 16, 32 or 64", *cellBits)
+	}
+
+	optLevel := maxOptLevel
+	optLevelsSet := 0
+	for level, set := range optLevels {
+		if *set {
+			optLevel = level
+			optLevelsSet += 1
+		}
+	}
+	if optLevelsSet > 1 {
+		log.Fatalf("only one of -O0, -O1 or -O2 can be used")
+	}
+	var disabled []string
+	for _, pass := range passes {
+		if *disablePasses[pass.Name] {
+			disabled = append(disabled, pass.Name)
+		}
+	}
+
+	// The debug information needs the full path, since the debugger
+	// could be run from another directory.
+	sourceFile, err := filepath.Abs(fileToCompile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	var outputFilename string
 	if *outputBinaryName != "" {
 		outputFilename = *outputBinaryName
@@ -167,12 +1188,36 @@ func main() {
 		outputFilename = strings.Replace(fileBase, filepath.Ext(fileBase), "", -1)
 	}
 
-	comp := NewCompiler(program)
-	if err := comp.ParseAndEmit(); err != nil {
+	opts := Options{
+		CellBits:      *cellBits,
+		TapeSize:      *tapeSize,
+		CheckBounds:   *checkBounds,
+		GuardPages:    *guardPages,
+		GrowTape:      *growTape,
+		EOF:           eof,
+		Unbuffered:    *unbuffered,
+		OptLevel:      optLevel,
+		DisablePasses: disabled,
+		Debug:         *debug,
+		SourceFile:    sourceFile,
+		PIE:           *pie,
+	}
+	executable, err := Compile(program, opts)
+	if err != nil {
 		log.Fatal(err)
 	}
-	if err := ioutil.WriteFile(outputFilename, comp.Build(), 0755); err != nil {
+	if err := ioutil.WriteFile(outputFilename, executable, 0755); err != nil {
 		log.Fatal(err)
 	}
 	fmt.Printf("wrote executable to %s\n", outputFilename)
+
+	if *stats {
+		passStats, err := PassStats(program, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, stat := range passStats {
+			fmt.Printf("%s: removed %d bytes\n", stat.Name, stat.Bytes)
+		}
+	}
 }
@@ -0,0 +1,1092 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"debug/dwarf"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// compileAndRun compiles the brainfuck program, runs the resulting
+// executable with stdin read from the file at inputPath and returns
+// what it wrote to stdout.
+func compileAndRun(t *testing.T, program string, opts Options, inputPath string) []byte {
+	t.Helper()
+
+	res := compileAndRunResult(t, program, opts, inputPath)
+	if res.exitCode != 0 {
+		t.Fatalf("compiled %q exited with %d: %s", program, res.exitCode, res.stderr)
+	}
+	return res.stdout
+}
+
+type runResult struct {
+	stdout   []byte
+	stderr   []byte
+	exitCode int
+}
+
+// compileAndRunResult is the same as compileAndRun, except it doesn't
+// fail the test if the executable exits with a non-zero status.
+func compileAndRunResult(t *testing.T, program string, opts Options, inputPath string) runResult {
+	t.Helper()
+	return run(t, compile(t, program, opts), inputPath)
+}
+
+// noEvaluate turns off running programs at compile time, for tests of
+// the code generated for programs that don't read any input.
+var noEvaluate = []string{"evaluate"}
+
+// compile compiles the brainfuck program to an executable.
+func compile(t *testing.T, program string, opts Options) []byte {
+	t.Helper()
+
+	binary, err := Compile([]byte(program), opts)
+	if err != nil {
+		t.Fatalf("unable to compile %q: %v", program, err)
+	}
+	return binary
+}
+
+// run runs the executable with stdin read from the file at inputPath.
+func run(t *testing.T, binary []byte, inputPath string) runResult {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "go-brainfunk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	executable := filepath.Join(dir, "bf")
+	if err := ioutil.WriteFile(executable, binary, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make sure a miscompiled program can't hang the tests.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, executable)
+	if inputPath != "" {
+		input, err := os.Open(inputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer input.Close()
+		cmd.Stdin = input
+	}
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+		return runResult{stdout.Bytes(), stderr.Bytes(), exitErr.ExitCode()}
+	} else if err != nil {
+		t.Fatalf("unable to run executable: %v", err)
+	}
+	return runResult{stdout.Bytes(), stderr.Bytes(), 0}
+}
+
+func TestInputEOF(t *testing.T) {
+	hello, err := ioutil.ReadFile("testdata/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		program  string
+		eof      EOFBehaviour
+		input    string
+		expected []byte
+	}{
+		{"cat eof zero", ",[.,]", EOFZero, "testdata/hello.txt", hello},
+		{"cat eof minus1", ",+[-.,+]", EOFMinusOne, "testdata/hello.txt", hello},
+		{"keep", ",.,.", EOFKeep, "testdata/a.txt", []byte("aa")},
+		{"zero", ",.,.", EOFZero, "testdata/a.txt", []byte("a\x00")},
+		{"minus1", ",.,+.", EOFMinusOne, "testdata/a.txt", []byte("a\x00")},
+		{"keep empty input", "+++,.", EOFKeep, os.DevNull, []byte{3}},
+		{"zero empty input", "+++,.", EOFZero, os.DevNull, []byte{0}},
+		{"minus1 empty input", "+++,.", EOFMinusOne, os.DevNull, []byte{0xff}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := compileAndRun(t, tt.program, Options{EOF: tt.eof}, tt.input)
+			if !bytes.Equal(output, tt.expected) {
+				t.Errorf("unexpected output %q, expected %q", output, tt.expected)
+			}
+		})
+	}
+}
+
+func TestBufferedOutput(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		input   string
+		length  int
+	}{
+		{"hello world", "++++++++[>++++[>++>+++>+++>+<<<<-]>+>+>->>+[<]<-]>>.>---.+++++++..+++.>>.<-.<.+++.------.--------.>>+.>++.", "", 13},
+		// Outputs more than the size of the output buffer.
+		{"larger than buffer", "++++++++++[>++++++++++[>++++++++++[>++++++++++[>>+++++[<+>-]<.<-]<-]<-]<-]", "", 10000},
+		{"output before and after input", "+++++++[>++++++++++<-]>.,.>,.", "testdata/a.txt", 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffered := compileAndRun(t, tt.program, Options{}, tt.input)
+			unbuffered := compileAndRun(t, tt.program, Options{Unbuffered: true}, tt.input)
+			if len(buffered) != tt.length {
+				t.Errorf("unexpected output length %d, expected %d", len(buffered), tt.length)
+			}
+			if !bytes.Equal(buffered, unbuffered) {
+				t.Errorf("buffered output %q doesn't match unbuffered output %q", buffered, unbuffered)
+			}
+		})
+	}
+}
+
+func TestCellBits(t *testing.T) {
+	// Leaves 256 in the current cell, then outputs 1 if the current
+	// cell isn't zero.
+	is256Zero := "++++++++++++++++[>++++++++++++++++<-]>[>+<[-]]>."
+	// Leaves 65536 in the current cell, then outputs 1 if the current
+	// cell isn't zero.
+	is65536Zero := "++++++++++++++++[>++++++++++++++++[>++++++++++++++++[>++++++++++++++++<-]<-]<-]>>>[>+<[-]]>."
+
+	tests := []struct {
+		name     string
+		cellBits int
+		program  string
+		expected []byte
+	}{
+		{"8 bit 255+1", 8, is256Zero, []byte{0}},
+		{"16 bit 255+1", 16, is256Zero, []byte{1}},
+		{"32 bit 255+1", 32, is256Zero, []byte{1}},
+		{"64 bit 255+1", 64, is256Zero, []byte{1}},
+		{"16 bit 65535+1", 16, is65536Zero, []byte{0}},
+		{"32 bit 65535+1", 32, is65536Zero, []byte{1}},
+		{"8 bit 0-1", 8, "-[>+<-]>.", []byte{0xff}},
+		{"16 bit 0-1", 16, "-[>+<-]>.", []byte{0xff}},
+		// Runs of + and - are folded into a single add or sub.
+		{"8 bit 257 folded", 8, strings.Repeat("+", 257) + ".", []byte{1}},
+		{"8 bit -255 folded", 8, strings.Repeat("-", 255) + ".", []byte{1}},
+		{"16 bit 65535+1 folded", 16, strings.Repeat("+", 65536) + "[>+<[-]]>.", []byte{0}},
+		{"64 bit 200-201 folded", 64, strings.Repeat("+", 200) + strings.Repeat("-", 201) + "[>+<+]>.", []byte{1}},
+		{"8 bit input", 8, ",.", []byte("a")},
+		{"8 bit eof minus1", 8, ",,+.", []byte{0}},
+		{"16 bit eof minus1", 16, ",,+[>+<-]>.", []byte{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, opts := range []Options{
+				{CellBits: tt.cellBits, EOF: EOFMinusOne},
+				{CellBits: tt.cellBits, EOF: EOFMinusOne, OptLevel: maxOptLevel},
+				{CellBits: tt.cellBits, EOF: EOFMinusOne, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+			} {
+				output := compileAndRun(t, tt.program, opts, "testdata/a.txt")
+				if !bytes.Equal(output, tt.expected) {
+					t.Errorf("%+v: unexpected output %q, expected %q", opts, output, tt.expected)
+				}
+			}
+		})
+	}
+}
+
+// bssSize returns the size in memory of the writable segment that
+// holds the tape.
+func bssSize(t *testing.T, program string, opts Options) uint64 {
+	t.Helper()
+
+	f, err := elf.NewFile(bytes.NewReader(compile(t, program, opts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_W != 0 {
+			// Hardening checks expect no segment to be both
+			// writable and executable.
+			if prog.Flags&elf.PF_X != 0 {
+				t.Errorf("segment at %#x is writable and executable", prog.Vaddr)
+			}
+			return prog.Memsz
+		}
+	}
+	t.Fatal("no writable segment found")
+	return 0
+}
+
+func TestTextSegment(t *testing.T) {
+	// The text segment is mapped from the start of the file, so has to
+	// cover everything up to the end of the code, otherwise the end of
+	// the code isn't mapped when it is on a different page to the rest.
+	binary := compile(t, "+.", Options{})
+	f, err := elf.NewFile(bytes.NewReader(binary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := f.Section(".text")
+	if text == nil {
+		t.Fatal("no .text section")
+	}
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_W == 0 && prog.Filesz != text.Offset+text.Size {
+			t.Errorf("text segment is %d bytes, expected %d bytes", prog.Filesz, text.Offset+text.Size)
+		}
+	}
+}
+
+func TestSectionHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		opts     Options
+		sections []string
+	}{
+		{"bss", "+.", Options{}, []string{"", ".text", ".bss", ".symtab", ".strtab", ".shstrtab"}},
+		// The tape starts off with the cells set at compile time.
+		{"data", "+>,<.", Options{OptLevel: maxOptLevel}, []string{"", ".text", ".bss", ".data", ".symtab", ".strtab", ".shstrtab"}},
+	}
+
+	for _, tt := range tests {
+		binary := compile(t, tt.program, tt.opts)
+		f, err := elf.NewFile(bytes.NewReader(binary))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, section := range f.Sections {
+			names = append(names, section.Name)
+		}
+		if !reflect.DeepEqual(names, tt.sections) {
+			t.Errorf("%s: unexpected sections %q, expected %q", tt.name, names, tt.sections)
+		}
+
+		// Each loaded section is in the segment at the same address.
+		for _, section := range f.Sections {
+			if section.Flags&elf.SHF_ALLOC == 0 {
+				continue
+			}
+			if section.Name == ".text" && (f.Entry < section.Addr || f.Entry >= section.Addr+section.Size) {
+				t.Errorf("%s: entry point %#x isn't in the .text section", tt.name, f.Entry)
+			}
+			found := false
+			for _, prog := range f.Progs {
+				if prog.Type == elf.PT_LOAD && section.Addr >= prog.Vaddr && section.Addr+section.Size <= prog.Vaddr+prog.Memsz &&
+					(section.Type == elf.SHT_NOBITS || section.Offset-prog.Off == section.Addr-prog.Vaddr) {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("%s: %s section isn't in a segment", tt.name, section.Name)
+			}
+		}
+		if data := f.Section(".data"); data != nil {
+			contents, err := data.Data()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected := []byte{1, 0, 0, 0, 0, 0, 0, 0}; !bytes.Equal(contents, expected) {
+				t.Errorf("%s: unexpected .data %v, expected %v", tt.name, contents, expected)
+			}
+		}
+
+		// readelf checks a lot more than debug/elf does, and warns
+		// about anything that doesn't look right.
+		if _, err := exec.LookPath("readelf"); err != nil {
+			continue
+		}
+		dir, err := ioutil.TempDir("", "go-brainfunk")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		executable := filepath.Join(dir, "bf")
+		if err := ioutil.WriteFile(executable, binary, 0755); err != nil {
+			t.Fatal(err)
+		}
+		var stderr bytes.Buffer
+		cmd := exec.Command("readelf", "-a", executable)
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil || stderr.Len() > 0 {
+			t.Errorf("%s: readelf -a failed: %v: %s", tt.name, err, stderr.String())
+		}
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	tests := []struct {
+		name    string
+		program string
+		opts    Options
+		symbols []string
+	}{
+		{"buffered", "+[-[>]<].,", Options{}, []string{
+			"output_buffer", "bf_flush", "bf_write", "bf_read", "tape",
+			"loop_1_start", "loop_2_start", "loop_2_end", "loop_1_end", "_start",
+		}},
+		{"unbuffered", ".", Options{Unbuffered: true}, []string{"bf_write", "bf_read", "tape", "_start"}},
+		{"guard pages", ".", Options{Unbuffered: true, GuardPages: true, CheckBounds: true}, []string{
+			"bf_write", "bf_read", "bf_alloc_error_message", "bf_alloc_error", "bf_bounds_error_message",
+			"bf_bounds_error", "bf_tape_error_message", "bf_tape_error", "bf_segv_error_message", "bf_segv_error",
+			"bf_sigreturn", "bf_segv_handler", "_start",
+		}},
+		{"grow tape", ".", Options{Unbuffered: true, GrowTape: true}, []string{
+			"bf_write", "bf_read", "bf_alloc_error_message", "bf_alloc_error", "bf_grow", "_start",
+		}},
+		// Output written at compile time is data in the .text section.
+		{"evaluate", "+++++++[>++++++++++<-]>.,", Options{OptLevel: maxOptLevel}, []string{
+			"output_buffer", "bf_flush", "bf_write", "bf_read", "initial_output", "tape", "_start",
+		}},
+	}
+
+	for _, tt := range tests {
+		f, err := elf.NewFile(bytes.NewReader(compile(t, tt.program, tt.opts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		symbols, err := f.Symbols()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs := make(map[string]uint64)
+		var names []string
+		for _, sym := range symbols {
+			names = append(names, sym.Name)
+			addrs[sym.Name] = sym.Value
+		}
+		if !reflect.DeepEqual(names, tt.symbols) {
+			t.Errorf("%s: unexpected symbols %q, expected %q", tt.name, names, tt.symbols)
+			continue
+		}
+
+		text := f.Section(".text")
+		for _, sym := range symbols {
+			switch {
+			case sym.Name == "_start":
+				if elf.ST_BIND(sym.Info) != elf.STB_GLOBAL || sym.Value != f.Entry {
+					t.Errorf("%s: _start is %+v, expected a global symbol at the entry point %#x", tt.name, sym, f.Entry)
+				}
+			case elf.ST_BIND(sym.Info) != elf.STB_LOCAL:
+				t.Errorf("%s: %s isn't local", tt.name, sym.Name)
+			}
+			if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && (sym.Value < text.Addr || sym.Value+sym.Size > text.Addr+text.Size || sym.Size == 0) {
+				t.Errorf("%s: function %s at %#x with size %d isn't in the .text section", tt.name, sym.Name, sym.Value, sym.Size)
+			}
+		}
+		// Loops are nested in the same way as in the program.
+		if start, end := addrs["loop_1_start"], addrs["loop_1_end"]; start != 0 {
+			if !(start < addrs["loop_2_start"] && addrs["loop_2_start"] < addrs["loop_2_end"] && addrs["loop_2_end"] < end) {
+				t.Errorf("%s: loops aren't nested: %v", tt.name, addrs)
+			}
+		}
+	}
+}
+
+func TestDebugLines(t *testing.T) {
+	program := "++\n[->+<]\n>."
+	opts := Options{OptLevel: 0, Debug: true, SourceFile: "/src/test.bf"}
+	binary := compile(t, program, opts)
+	if output := run(t, binary, "").stdout; !bytes.Equal(output, []byte{2}) {
+		t.Errorf("unexpected output %v, expected [2]", output)
+	}
+
+	f, err := elf.NewFile(bytes.NewReader(binary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := f.DWARF()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cu, err := d.Reader().Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := cu.Val(dwarf.AttrName); name != opts.SourceFile {
+		t.Errorf("unexpected name %v, expected %q", name, opts.SourceFile)
+	}
+	lr, err := d.LineReader(cu)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every command is a row of its own at -O0, including the ] at
+	// the end of the loop, and the exit is at line 0.
+	expected := []string{"1:1", "1:2", "2:1", "2:2", "2:3", "2:4", "2:5", "2:6", "3:1", "3:2", "0:0"}
+	text := f.Section(".text")
+	var positions []string
+	var entry dwarf.LineEntry
+	addr := text.Addr
+	for {
+		if err := lr.Next(&entry); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Address < addr || entry.Address > text.Addr+text.Size {
+			t.Errorf("row %+v is at %#x, expected it in the .text section after %#x", entry, entry.Address, addr)
+		}
+		addr = entry.Address
+		if entry.EndSequence {
+			if entry.Address != text.Addr+text.Size {
+				t.Errorf("line table ends at %#x, expected the end of the .text section %#x", entry.Address, text.Addr+text.Size)
+			}
+			continue
+		}
+		positions = append(positions, fmt.Sprintf("%d:%d", entry.Line, entry.Column))
+	}
+	if !reflect.DeepEqual(positions, expected) {
+		t.Errorf("unexpected positions %q, expected %q", positions, expected)
+	}
+
+	// There is no debug information without -g.
+	f, err = elf.NewFile(bytes.NewReader(compile(t, program, Options{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if section := f.Section(".debug_line"); section != nil {
+		t.Errorf("unexpected .debug_line section without debug information")
+	}
+}
+
+func TestDebugVariables(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		opts     Options
+		cells    int64
+		cellType string
+		cellSize int64
+	}{
+		{"bss", "+.", Options{CellBits: 8, TapeSize: 100}, 100, "uint8_t", 1},
+		// The tape starts off with the cells set at compile time.
+		{"data", "+>,<.", Options{CellBits: 16, TapeSize: 100, OptLevel: maxOptLevel}, 100, "uint16_t", 2},
+		// The tape is rounded up to a whole number of pages.
+		{"guard pages", "+.", Options{CellBits: 32, TapeSize: 100, GuardPages: true}, pageSize / 4, "uint32_t", 4},
+		{"grow tape", "+.", Options{TapeSize: 100, GrowTape: true}, pageSize / 8, "uint64_t", 8},
+		{"mmap", "+.", Options{CellBits: 8, TapeSize: maxStaticTapeBytes + 1}, maxStaticTapeBytes + 1, "uint8_t", 1},
+	}
+
+	for _, tt := range tests {
+		tt.opts.Debug, tt.opts.SourceFile = true, "/src/test.bf"
+		f, err := elf.NewFile(bytes.NewReader(compile(t, tt.program, tt.opts)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := f.DWARF()
+		if err != nil {
+			t.Fatal(err)
+		}
+		variables := make(map[string]*dwarf.Entry)
+		for r := d.Reader(); ; {
+			entry, err := r.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry == nil {
+				break
+			}
+			if entry.Tag == dwarf.TagVariable {
+				variables[entry.Val(dwarf.AttrName).(string)] = entry
+			}
+		}
+		if variables["tape"] == nil || variables["ptr"] == nil {
+			t.Errorf("%s: unexpected variables %v, expected tape and ptr", tt.name, variables)
+			continue
+		}
+
+		typ, err := d.Type(variables["tape"].Val(dwarf.AttrType).(dwarf.Offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The cells are DW_ATE_unsigned integers rather than characters,
+		// which debug/dwarf decodes as a UintType.
+		isCell := func(typ dwarf.Type) bool {
+			cell, ok := typ.(*dwarf.UintType)
+			return ok && cell.ByteSize == tt.cellSize && cell.Name == tt.cellType
+		}
+		if array, ok := typ.(*dwarf.ArrayType); !ok || array.Count != tt.cells || !isCell(array.Type) {
+			t.Errorf("%s: unexpected tape type %#v, expected %s[%d]", tt.name, typ, tt.cellType, tt.cells)
+		}
+		typ, err = d.Type(variables["ptr"].Val(dwarf.AttrType).(dwarf.Offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ptr, ok := typ.(*dwarf.PtrType); !ok || !isCell(ptr.Type) {
+			t.Errorf("%s: unexpected ptr type %#v, expected *%s", tt.name, typ, tt.cellType)
+		}
+
+		location, _ := variables["tape"].Val(dwarf.AttrLocation).([]byte)
+		switch {
+		case tt.opts.GuardPages, tt.name == "mmap":
+			// The address of the tape is stored in the .bss segment:
+			// DW_OP_addr tapeStart ; DW_OP_deref
+			if len(location) != 10 || location[0] != 0x03 || location[9] != 0x06 {
+				t.Errorf("%s: unexpected tape location %x", tt.name, location)
+			}
+		case tt.opts.GrowTape:
+			// Only in RBP while the brainfuck program runs, so it is
+			// a location list like ptr's.
+			if location != nil {
+				t.Errorf("%s: unexpected tape location %x, expected a location list", tt.name, location)
+			}
+		default:
+			symbols, err := f.Symbols()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var addr uint64
+			for _, sym := range symbols {
+				if sym.Name == "tape" {
+					addr = sym.Value
+				}
+			}
+			expected := []byte{0x03, 0, 0, 0, 0, 0, 0, 0, 0} // DW_OP_addr
+			binary.LittleEndian.PutUint64(expected[1:], addr)
+			if !bytes.Equal(location, expected) {
+				t.Errorf("%s: unexpected tape location %x, expected %x", tt.name, location, expected)
+			}
+		}
+	}
+}
+
+func TestPIE(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		opts     Options
+		stdout   []byte
+		stderr   string
+		exitCode int
+	}{
+		{"buffered", "++++++++[>++++++++<-]>+.,.", Options{}, []byte("Aa"), "", 0},
+		{"unbuffered", "++++++++[>++++++++<-]>+.,.", Options{Unbuffered: true}, []byte("Aa"), "", 0},
+		// The output so far is in the .text segment and the tape in the
+		// .data segment.
+		{"evaluated", "++++++++[>++++++++<-]>+.,.", Options{OptLevel: maxOptLevel}, []byte("Aa"), "", 0},
+		{"check bounds", "+.<", Options{CheckBounds: true}, []byte{1}, "tape pointer out of range at source offset 2\n", tapeOutOfRangeExitCode},
+		{"guard pages", "+.[>+]", Options{GuardPages: true, CellBits: 8}, []byte{1}, "tape access out of range\n", tapeOutOfRangeExitCode},
+		{"grow tape", ">>>>>>>>+.", Options{GrowTape: true, TapeSize: 4}, []byte{1}, "", 0},
+	}
+
+	for _, tt := range tests {
+		tt.opts.PIE = true
+		binary := compile(t, tt.program, tt.opts)
+		f, err := elf.NewFile(bytes.NewReader(binary))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The addresses are relative to where the executable is
+		// loaded, so start from 0.
+		if f.Type != elf.ET_DYN || f.Progs[0].Vaddr != 0 {
+			t.Errorf("%s: unexpected type %s loaded at %#x, expected %s loaded at 0", tt.name, f.Type, f.Progs[0].Vaddr, elf.ET_DYN)
+		}
+
+		res := run(t, binary, "testdata/a.txt")
+		if res.exitCode != tt.exitCode {
+			t.Errorf("%s: unexpected exit code %d, expected %d", tt.name, res.exitCode, tt.exitCode)
+		}
+		if !bytes.Equal(res.stdout, tt.stdout) {
+			t.Errorf("%s: unexpected output %q, expected %q", tt.name, res.stdout, tt.stdout)
+		}
+		if string(res.stderr) != tt.stderr {
+			t.Errorf("%s: unexpected error output %q, expected %q", tt.name, res.stderr, tt.stderr)
+		}
+	}
+}
+
+func TestTapeSize(t *testing.T) {
+	for _, cellBits := range []int{8, 16, 32, 64} {
+		small := bssSize(t, "+.", Options{CellBits: cellBits, TapeSize: 1})
+		large := bssSize(t, "+.", Options{CellBits: cellBits, TapeSize: 1 << 25})
+		if expected := uint64(1<<25-1) * uint64(cellBits/8); large-small != expected {
+			t.Errorf("%d bit cells: tape of 1<<25 cells is %d bytes larger than a tape of 1 cell, expected %d", cellBits, large-small, expected)
+		}
+	}
+
+	// Tapes much larger than the 0x200000 bytes between the .text and
+	// .bss segments still load and run.
+	output := compileAndRun(t, ">>>>>+++++++[<++++++++++>-]<.", Options{TapeSize: 1 << 24}, "")
+	if !bytes.Equal(output, []byte("F")) {
+		t.Errorf("unexpected output %q, expected %q", output, "F")
+	}
+}
+
+func TestLargeTape(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"8GiB", Options{CellBits: 8, TapeSize: 1 << 33}},
+		{"largest", Options{CellBits: 8, TapeSize: maxTapeBytes}},
+		{"check bounds", Options{CellBits: 64, TapeSize: maxTapeBytes / 8, CheckBounds: true}},
+	}
+
+	for _, tt := range tests {
+		// The tape isn't in the .bss segment, which the kernel would
+		// have to reserve memory for before the program runs.
+		if size := bssSize(t, "+.", tt.opts); size > maxStaticTapeBytes {
+			t.Errorf("%s: unexpected .bss segment of %d bytes", tt.name, size)
+		}
+		output := compileAndRun(t, "+++++++[>++++++++++<-]>.", tt.opts, "")
+		if !bytes.Equal(output, []byte("F")) {
+			t.Errorf("%s: unexpected output %q, expected %q", tt.name, output, "F")
+		}
+	}
+}
+
+func TestTapeTooLarge(t *testing.T) {
+	tests := []struct {
+		opts    Options
+		invalid bool
+	}{
+		{Options{CellBits: 8, TapeSize: maxTapeBytes}, false},
+		{Options{CellBits: 8, TapeSize: maxTapeBytes + 1}, true},
+		{Options{CellBits: 32, TapeSize: maxTapeBytes/4 + 1}, true},
+		{Options{TapeSize: maxTapeBytes / 8}, false},
+		// The size in bytes wraps around to 0.
+		{Options{CellBits: 64, TapeSize: 1 << 61}, true},
+	}
+
+	for _, tt := range tests {
+		err := NewCompiler([]byte("+."), tt.opts).ParseAndEmit()
+		if tt.invalid && err == nil {
+			t.Errorf("expected an error for a tape of %d %d-bit cells", tt.opts.TapeSize, tt.opts.CellBits)
+		} else if !tt.invalid && err != nil {
+			t.Errorf("unexpected error for a tape of %d %d-bit cells: %v", tt.opts.TapeSize, tt.opts.CellBits, err)
+		}
+	}
+}
+
+func TestProgramTooLarge(t *testing.T) {
+	comp := NewCompiler([]byte(strings.Repeat("+>", 1<<19)), Options{})
+	if err := comp.ParseAndEmit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := comp.Build(); err == nil {
+		t.Errorf("expected an error for generated code larger than the .text segment")
+	}
+}
+
+func TestCheckBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		stdout   []byte
+		stderr   string
+		exitCode int
+	}{
+		{"in range", ">>>+<<<.", []byte{0}, "", 0},
+		{"before start", "+.<+", []byte{1}, "tape pointer out of range at source offset 2\n", tapeOutOfRangeExitCode},
+		{"past end", "+++[>+++<-]>>>+>", nil, "tape pointer out of range at source offset 15\n", tapeOutOfRangeExitCode},
+		{"past end in loop", "+[>+]", nil, "tape pointer out of range at source offset 2\n", tapeOutOfRangeExitCode},
+		// Runs of moves are reported at the move that went out of
+		// range, not the first in the run.
+		{"past end in a run", "+>>>>>>>+", nil, "tape pointer out of range at source offset 4\n", tapeOutOfRangeExitCode},
+		{"past end in a run in a loop", "+[>>>>>>>>-]", nil, "tape pointer out of range at source offset 5\n", tapeOutOfRangeExitCode},
+	}
+
+	for _, tt := range tests {
+		// The offsets reported are the same with every pass run.
+		for _, optLevel := range []int{0, maxOptLevel} {
+			t.Run(fmt.Sprintf("%s -O%d", tt.name, optLevel), func(t *testing.T) {
+				opts := Options{CheckBounds: true, TapeSize: 4, OptLevel: optLevel}
+				res := compileAndRunResult(t, tt.program, opts, "")
+				if res.exitCode != tt.exitCode {
+					t.Errorf("unexpected exit code %d, expected %d", res.exitCode, tt.exitCode)
+				}
+				if !bytes.Equal(res.stdout, tt.stdout) {
+					t.Errorf("unexpected output %q, expected %q", res.stdout, tt.stdout)
+				}
+				if string(res.stderr) != tt.stderr {
+					t.Errorf("unexpected error output %q, expected %q", res.stderr, tt.stderr)
+				}
+			})
+		}
+	}
+}
+
+func TestGuardPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		stdout   []byte
+		exitCode int
+	}{
+		{"in range", ">>>+<<<.", []byte{0}, 0},
+		{"before start", "+.<+", []byte{1}, tapeOutOfRangeExitCode},
+		{"past end", "+.[>+]", []byte{1}, tapeOutOfRangeExitCode},
+		{"input", ">,.", []byte("a"), 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cellBits := range []int{8, 64} {
+				opts := Options{GuardPages: true, CellBits: cellBits, TapeSize: 4096}
+				res := compileAndRunResult(t, tt.program, opts, "testdata/a.txt")
+				if res.exitCode != tt.exitCode {
+					t.Errorf("%d bit cells: unexpected exit code %d, expected %d", cellBits, res.exitCode, tt.exitCode)
+				}
+				if !bytes.Equal(res.stdout, tt.stdout) {
+					t.Errorf("%d bit cells: unexpected output %q, expected %q", cellBits, res.stdout, tt.stdout)
+				}
+				if tt.exitCode != 0 && string(res.stderr) != "tape access out of range\n" {
+					t.Errorf("%d bit cells: unexpected error output %q", cellBits, res.stderr)
+				}
+			}
+		})
+	}
+}
+
+func TestGrowTape(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		stdout   []byte
+		exitCode int
+	}{
+		{"in range", ">>>+<<<.", []byte{0}, 0},
+		// The tape is rounded up to a page, so 20000 cells grows it
+		// several times.
+		{"past end and back", "+>+" + strings.Repeat(">", 20000) + "+" + strings.Repeat("<", 20000) + "<.>.", []byte{1, 1}, 0},
+		{"before start", "+.<+", []byte{1}, tapeOutOfRangeExitCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, cellBits := range []int{8, 64} {
+				opts := Options{GrowTape: true, CheckBounds: true, CellBits: cellBits, TapeSize: 4}
+				res := compileAndRunResult(t, tt.program, opts, "")
+				if res.exitCode != tt.exitCode {
+					t.Errorf("%d bit cells: unexpected exit code %d, expected %d: %s", cellBits, res.exitCode, tt.exitCode, res.stderr)
+				}
+				if !bytes.Equal(res.stdout, tt.stdout) {
+					t.Errorf("%d bit cells: unexpected output %q, expected %q", cellBits, res.stdout, tt.stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestClearLoops(t *testing.T) {
+	// The [+] loops on cells holding 65 and -1 would take a very long
+	// time with 64-bit cells if they weren't replaced by a store, so
+	// the binary without clear loops is only run for smaller cells.
+	program := "++++++++++++++++[>++++++++++++++++<-]>[-]++++++++[>++++++++<-]>+.[+]-[+]."
+
+	for _, cellBits := range []int{8, 16, 64} {
+		after := Options{CellBits: cellBits, OptLevel: 1}
+		before := after
+		before.DisablePasses = []string{"clear-loops"}
+		beforeBinary := compile(t, program, before)
+		afterBinary := compile(t, program, after)
+		if len(afterBinary) >= len(beforeBinary) {
+			t.Errorf("%d bit cells: binary with clear loops is %d bytes, expected it to be smaller than %d bytes", cellBits, len(afterBinary), len(beforeBinary))
+		}
+
+		expected := []byte{'A', 0}
+		res := run(t, afterBinary, "")
+		if !bytes.Equal(res.stdout, expected) {
+			t.Errorf("%d bit cells: unexpected output %q, expected %q", cellBits, res.stdout, expected)
+		}
+		if cellBits != 64 {
+			if res := run(t, beforeBinary, ""); !bytes.Equal(res.stdout, expected) {
+				t.Errorf("%d bit cells: unexpected output %q without clear loops, expected %q", cellBits, res.stdout, expected)
+			}
+		}
+	}
+}
+
+func TestMultiplyLoops(t *testing.T) {
+	tests := []struct {
+		name     string
+		program  string
+		stdout   []byte
+		exitCode int
+	}{
+		// 5 * 13 = 65 'A', copied into two cells.
+		{"multiply", "+++++[>+++++++++++++>+++++++++++++<<-]>.>.", []byte("AA"), 0},
+		// 5 * -3 = -15 = 241.
+		{"multiply negative", ">>+++++[<<--->>-]<<.", []byte{241}, 0},
+		// Wraps around for 8-bit cells: 100 * 3 = 300 = 44 ','.
+		{"multiply wraps", "++++++++++[>++++++++++<-]>[->+++<]>.", []byte{','}, 0},
+		// The loop never runs, so the cell before the start of the
+		// tape is never accessed.
+		{"zero cell before start", "[-<+>]+.", []byte{1}, 0},
+		{"before start", "+.[-<+>]", []byte{1}, tapeOutOfRangeExitCode},
+		{"past end", "+.[->>>>+<<<<]", []byte{1}, tapeOutOfRangeExitCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, disable := range [][]string{nil, noEvaluate} {
+				opts := Options{CellBits: 8, CheckBounds: true, TapeSize: 4, OptLevel: maxOptLevel, DisablePasses: disable}
+				res := compileAndRunResult(t, tt.program, opts, "")
+				if res.exitCode != tt.exitCode {
+					t.Errorf("%v: unexpected exit code %d, expected %d: %s", disable, res.exitCode, tt.exitCode, res.stderr)
+				}
+				if !bytes.Equal(res.stdout, tt.stdout) {
+					t.Errorf("%v: unexpected output %q, expected %q", disable, res.stdout, tt.stdout)
+				}
+			}
+		})
+	}
+}
+
+func TestScanLoops(t *testing.T) {
+	// Fills the first 48 cells with their index+1, except for cell z
+	// which is left as zero. Then scans forwards for the zero from
+	// cell 0, and backwards from cell 47, outputting the cell before
+	// and after the zero.
+	scan := func(z int) string {
+		var program strings.Builder
+		for i := 0; i < 48; i++ {
+			if i != z {
+				program.WriteString(strings.Repeat("+", i+1))
+			}
+			program.WriteString(">")
+		}
+		program.WriteString(strings.Repeat("<", 48))
+		program.WriteString("[>]<.")
+		program.WriteString(strings.Repeat(">", 47-(z-1)))
+		program.WriteString("[<]>.")
+		return program.String()
+	}
+
+	for _, opts := range []Options{
+		{CellBits: 8, OptLevel: maxOptLevel},
+		{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+		{CellBits: 8, GuardPages: true, OptLevel: maxOptLevel},
+		{CellBits: 8, CheckBounds: true, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+		{CellBits: 16, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+	} {
+		for z := 1; z < 47; z++ {
+			output := compileAndRun(t, scan(z), opts, "")
+			if expected := []byte{byte(z), byte(z + 2)}; !bytes.Equal(output, expected) {
+				t.Errorf("%+v: zero at cell %d: unexpected output %v, expected %v", opts, z, output, expected)
+			}
+		}
+	}
+
+	// Scanning doesn't move the tape pointer when the current cell is
+	// already zero.
+	output := compileAndRun(t, "+>>+<[<]+[>]<<<.>.>.", Options{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: noEvaluate}, "")
+	if expected := []byte{1, 1, 1}; !bytes.Equal(output, expected) {
+		t.Errorf("unexpected output %v, expected %v", output, expected)
+	}
+}
+
+func TestStridedScanLoops(t *testing.T) {
+	// Fills the first 64 cells with their index+1, except for every
+	// cell that is out of step with cell start, and cell z, which are
+	// left as zero. Then scans from cell start for the zero, and
+	// outputs the cell one stride before it.
+	scan := func(start, z, stride int) string {
+		var program strings.Builder
+		for i := 0; i < 64; i++ {
+			if i != z && (i-start)%stride == 0 {
+				program.WriteString(strings.Repeat("+", i+1))
+			}
+			program.WriteString(">")
+		}
+		program.WriteString(strings.Repeat("<", 64-start))
+		if z > start {
+			program.WriteString("[" + strings.Repeat(">", stride) + "]")
+			program.WriteString(strings.Repeat("<", stride) + ".")
+		} else {
+			program.WriteString("[" + strings.Repeat("<", stride) + "]")
+			program.WriteString(strings.Repeat(">", stride) + ".")
+		}
+		return program.String()
+	}
+
+	for _, stride := range []int{2, 3, 4, 8, 16} {
+		for start := 0; start < 16; start++ {
+			// The first and last zero in step with start, forwards
+			// from start and backwards from the cell 16 from the end.
+			last := start + (63-start)/stride*stride
+			end := 47 + start
+			first := end - end/stride*stride
+			for _, tt := range []struct{ start, z int }{
+				{start, start + stride},
+				{start, last},
+				{end, end - stride},
+				{end, first},
+			} {
+				output := compileAndRun(t, scan(tt.start, tt.z, stride), Options{CellBits: 8, OptLevel: maxOptLevel}, "")
+				before := tt.z - stride
+				if tt.z < tt.start {
+					before = tt.z + stride
+				}
+				if expected := []byte{byte(before + 1)}; !bytes.Equal(output, expected) {
+					t.Errorf("stride %d from cell %d: zero at cell %d: unexpected output %v, expected %v", stride, tt.start, tt.z, output, expected)
+				}
+			}
+		}
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	// The moves between changing cells are replaced by offsets from
+	// the tape pointer, including negative ones.
+	program := ">>>+++<++<+>>>[-]<<<-[>>>+<<<++]>>>.<.<.<.>>[-<<+>>]+<<.>>.<<<+."
+	expected := []byte{0, 3, 2, 0, 3, 1, 1}
+
+	for _, opts := range []Options{
+		{CellBits: 8, OptLevel: maxOptLevel},
+		{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+		{CellBits: 64, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+		{CellBits: 8, GuardPages: true, OptLevel: maxOptLevel},
+		{CellBits: 8, CheckBounds: true, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+	} {
+		output := compileAndRun(t, program, opts, "")
+		if !bytes.Equal(output, expected) {
+			t.Errorf("%+v: unexpected output %v, expected %v", opts, output, expected)
+		}
+	}
+}
+
+func TestCellRegister(t *testing.T) {
+	tests := []struct {
+		name      string
+		program   string
+		inputPath string
+		expected  []byte
+	}{
+		// The cell is known to be zero after the first loop, but not
+		// after it is changed, so the scan has to move.
+		{"zero after loop", "+[-.]+[>>]" + strings.Repeat("+", 65) + ".", "", []byte{0, 'A'}},
+		// The multiply loop adds to the cell in the register.
+		{"multiply into register", "++>,[-<+>]<.", "testdata/a.txt", []byte{'c'}},
+		// The cell in the register is stale after reading into it.
+		{"input", "+,+.", "testdata/a.txt", []byte{'b'}},
+		{"input EOF", "+,+.", "", []byte{2}},
+	}
+
+	for _, tt := range tests {
+		for _, opts := range []Options{
+			{CellBits: 8, OptLevel: maxOptLevel},
+			{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+			{CellBits: 16, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+			{CellBits: 64, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+			{CellBits: 8, CheckBounds: true, OptLevel: maxOptLevel, DisablePasses: noEvaluate},
+			{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: []string{"cell-register", "evaluate"}},
+		} {
+			output := compileAndRun(t, tt.program, opts, tt.inputPath)
+			if !bytes.Equal(output, tt.expected) {
+				t.Errorf("%s, %+v: unexpected output %v, expected %v", tt.name, opts, output, tt.expected)
+			}
+		}
+	}
+}
+
+func TestDeadLoops(t *testing.T) {
+	// A comment loop at the start of the program and one straight
+	// after another loop, which both contain commands that would change
+	// the output if they were run.
+	program := "[This prints. a lot, of junk+]" + strings.Repeat("+", 65) + "[.[-]]" +
+		"[ and this. too]" + strings.Repeat("+", 49) + "."
+	expected := []byte("A1")
+
+	// Run at compile time the loops are never entered either way.
+	opts := Options{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: noEvaluate}
+	output := compileAndRun(t, program, opts, "")
+	if !bytes.Equal(output, expected) {
+		t.Errorf("unexpected output %q, expected %q", output, expected)
+	}
+
+	withDeadLoops := compile(t, program, opts)
+	opts.DisablePasses = append(opts.DisablePasses, "dead-loops")
+	withoutDeadLoops := compile(t, program, opts)
+	if len(withDeadLoops) >= len(withoutDeadLoops) {
+		t.Errorf("executable is %d bytes with dead loops removed, expected less than %d", len(withDeadLoops), len(withoutDeadLoops))
+	}
+	if res := run(t, withoutDeadLoops, ""); !bytes.Equal(res.stdout, expected) {
+		t.Errorf("-fno-dead-loops: unexpected output %q, expected %q", res.stdout, expected)
+	}
+}
+
+// initialisedData returns the number of bytes of initialised data in
+// the writable segments of the executable.
+func initialisedData(t *testing.T, binary []byte) uint64 {
+	t.Helper()
+
+	f, err := elf.NewFile(bytes.NewReader(binary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size uint64
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD && prog.Flags&elf.PF_W != 0 {
+			size += prog.Filesz
+		}
+	}
+	return size
+}
+
+func TestEvaluate(t *testing.T) {
+	tests := []struct {
+		name      string
+		program   string
+		opts      Options
+		inputPath string
+		stdout    []byte
+		exitCode  int
+		data      bool // Whether the tape starts off with initialised data.
+	}{
+		// Stops at reading input, after which the tape is what the
+		// program set it to.
+		{"input", "++++++++[>++++++++<-]>+.>,<+.>.", Options{}, "testdata/a.txt", []byte("ABa"), 0, true},
+		// A loop that takes too long is run when the program is.
+		{"long loop", strings.Repeat("+", 49) + ".[-]-[>-[>-[>-[>-<-]<-]<-]<-]" + strings.Repeat("+", 66) + ".", Options{}, "", []byte("1B"), 0, true},
+		// Moving past the end of the tape is left to be caught when
+		// the program is run.
+		{"out of range", "+.>>>>>.", Options{CheckBounds: true, TapeSize: 4}, "", []byte{1}, tapeOutOfRangeExitCode, true},
+		// The bounds of the tape are where the tape starts, not where
+		// the tape pointer is.
+		{"bounds", ">>>+.,<<<.>>>>.", Options{CheckBounds: true, TapeSize: 4}, "", []byte{1, 0}, tapeOutOfRangeExitCode, true},
+		{"64 bit cells", "->>-.,<<+++[>>+<<-]>>.", Options{CellBits: 64}, "", []byte{0xff, 1}, 0, true},
+		// Nothing needs to be left in the tape when the whole program
+		// is run at compile time.
+		{"whole program", "+++++[>+++++++++++++<-]>.", Options{}, "", []byte("A"), 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts.CellBits == 0 {
+				opts.CellBits = 8
+			}
+			opts.OptLevel = maxOptLevel
+			for _, disable := range [][]string{nil, noEvaluate} {
+				opts.DisablePasses = disable
+				binary := compile(t, tt.program, opts)
+				if data := initialisedData(t, binary) > 0; data != (tt.data && disable == nil) {
+					t.Errorf("%v: executable has initialised data %t", disable, data)
+				}
+				res := run(t, binary, tt.inputPath)
+				if res.exitCode != tt.exitCode {
+					t.Errorf("%v: unexpected exit code %d, expected %d: %s", disable, res.exitCode, tt.exitCode, res.stderr)
+				}
+				if !bytes.Equal(res.stdout, tt.stdout) {
+					t.Errorf("%v: unexpected output %q, expected %q", disable, res.stdout, tt.stdout)
+				}
+			}
+		})
+	}
+}
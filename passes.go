@@ -0,0 +1,148 @@
+package main
+
+import "github.com/vishen/go-brainfunk/ir"
+
+// Pass is an optimisation pass that rewrites the instructions of a
+// brainfuck program.
+type Pass struct {
+	// Name of the pass, -fno-<name> turns it off.
+	Name string
+	// Level is the lowest optimisation level the pass is run at.
+	Level int
+	// Run rewrites the instructions, it is nil for passes that
+	// change how the instructions are lowered to x64 instead, or that
+	// run them at compile time.
+	Run func(instrs []ir.Instr) []ir.Instr
+	// RunCheckBounds is run instead of Run with -check-bounds, can be
+	// nil.
+	RunCheckBounds func(instrs []ir.Instr) []ir.Instr
+	// Skip returns true if the pass can't be run with the options,
+	// can be nil.
+	Skip func(opts Options) bool
+}
+
+// Highest optimisation level, which is also the default.
+const maxOptLevel = 2
+
+// passes is the pipeline of optimisation passes, in the order they are
+// run in.
+var passes = []Pass{
+	{
+		Name:  "fold",
+		Level: 1,
+		Run:   ir.Fold,
+		// Out of range moves are reported at the move that went out
+		// of range, which is lost when it is folded into the moves
+		// before it.
+		RunCheckBounds: ir.FoldAdds,
+	},
+	{Name: "clear-loops", Level: 1, Run: ir.ClearLoops},
+	{Name: "multiply-loops", Level: 2, Run: ir.MultiplyLoops},
+	{Name: "scan-loops", Level: 2, Run: ir.ScanLoops},
+	{
+		Name:  "offsets",
+		Level: 2,
+		Run:   ir.Offsets,
+		// Out of range moves are reported at the move that went out
+		// of range, which doesn't exist anymore once the moves are
+		// replaced by offsets.
+		Skip: func(opts Options) bool { return opts.CheckBounds || opts.GrowTape },
+	},
+	{Name: "dead-loops", Level: 1, Run: ir.DeadLoops},
+	{
+		Name:  "evaluate",
+		Level: 2,
+		// The tape is allocated when the program is run, so it can't
+		// start off with the cells set at compile time.
+		Skip: mmapTape,
+	},
+	{Name: "cell-register", Level: 2},
+	{Name: "peephole", Level: 2},
+}
+
+// enabled returns true if the pass is run with the options.
+func (p Pass) enabled(opts Options) bool {
+	if p.Level > opts.OptLevel {
+		return false
+	}
+	for _, name := range opts.DisablePasses {
+		if name == p.Name {
+			return false
+		}
+	}
+	return p.Skip == nil || !p.Skip(opts)
+}
+
+// passEnabled returns true if the pass called name is run with the
+// options.
+func passEnabled(name string, opts Options) bool {
+	for _, pass := range passes {
+		if pass.Name == name {
+			return pass.enabled(opts)
+		}
+	}
+	return false
+}
+
+// Optimise runs the passes enabled by the options over the
+// instructions.
+func Optimise(instrs []ir.Instr, opts Options) []ir.Instr {
+	for _, pass := range passes {
+		if pass.Run == nil || !pass.enabled(opts) {
+			continue
+		}
+		if opts.CheckBounds && pass.RunCheckBounds != nil {
+			instrs = pass.RunCheckBounds(instrs)
+		} else {
+			instrs = pass.Run(instrs)
+		}
+	}
+	return instrs
+}
+
+// PassStat is how much smaller the code is for running a pass.
+type PassStat struct {
+	Name string
+	// Bytes of code removed by the pass, negative if the pass added
+	// code.
+	Bytes int
+}
+
+// PassStats finds how many bytes of code each pass enabled by the
+// options removes, by compiling the program again without each pass.
+// Code that another pass would also have removed isn't counted, so
+// passes that overlap can each show less than they remove on their
+// own.
+func PassStats(program []byte, opts Options) ([]PassStat, error) {
+	size, err := codeSize(program, opts)
+	if err != nil {
+		return nil, err
+	}
+	var stats []PassStat
+	for _, pass := range passes {
+		if !pass.enabled(opts) {
+			continue
+		}
+		without := opts
+		without.DisablePasses = append(opts.DisablePasses[:len(opts.DisablePasses):len(opts.DisablePasses)], pass.Name)
+		withoutSize, err := codeSize(program, without)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, PassStat{Name: pass.Name, Bytes: withoutSize - size})
+	}
+	return stats, nil
+}
+
+// codeSize returns the size of the code the program compiles to, which
+// doesn't include the rest of the executable, eg: the symbol table.
+func codeSize(program []byte, opts Options) (int, error) {
+	comp := NewCompiler(program, opts)
+	if err := comp.ParseAndEmit(); err != nil {
+		return 0, err
+	}
+	if _, err := comp.Build(); err != nil {
+		return 0, err
+	}
+	return int(comp.x64.CurrentOffset()), nil
+}
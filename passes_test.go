@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+// passesProgram has something for every pass to do: runs to fold, a
+// multiply loop, a clear loop, a scan loop, straight-line moves and a
+// loop that is never entered. They are all after reading input, which
+// stops the program being run at compile time from there on.
+const passesProgram = "+++++++++++++++++++++++++++++++++.[-]," +
+	"+++++[>+++++++++++++<-]>.[+]+>>>>+<<<<[>][.]>++++++[>++++++++<-]>.<<<++.>>>+."
+
+// passesOutput is the output of passesProgram when there is no input.
+var passesOutput = []byte{'!', 'A', '0', 3, '1'}
+
+func TestOptLevels(t *testing.T) {
+	hello, err := ioutil.ReadFile("examples/hello_world.bf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		program  string
+		expected []byte
+	}{
+		{string(hello), []byte("Hello World!\n")},
+		{passesProgram, passesOutput},
+	}
+
+	for _, tt := range tests {
+		for optLevel := 0; optLevel <= maxOptLevel; optLevel++ {
+			opts := Options{CellBits: 8, OptLevel: optLevel}
+			output := compileAndRun(t, tt.program, opts, "")
+			if !bytes.Equal(output, tt.expected) {
+				t.Errorf("-O%d: unexpected output %q, expected %q", optLevel, output, tt.expected)
+			}
+		}
+	}
+}
+
+func TestDisablePasses(t *testing.T) {
+	expected := passesOutput
+
+	full := compile(t, passesProgram, Options{CellBits: 8, OptLevel: maxOptLevel})
+	for _, pass := range passes {
+		opts := Options{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: []string{pass.Name}}
+		binary := compile(t, passesProgram, opts)
+		if bytes.Equal(binary, full) {
+			t.Errorf("-fno-%s: binary is unchanged", pass.Name)
+		}
+		if res := run(t, binary, ""); !bytes.Equal(res.stdout, expected) {
+			t.Errorf("-fno-%s: unexpected output %q, expected %q", pass.Name, res.stdout, expected)
+		}
+	}
+}
+
+func TestPassStats(t *testing.T) {
+	opts := Options{CellBits: 8, OptLevel: maxOptLevel}
+	stats, err := PassStats([]byte(passesProgram), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := textSize(t, compile(t, passesProgram, opts))
+	var names []string
+	for _, stat := range stats {
+		names = append(names, stat.Name)
+		without := Options{CellBits: 8, OptLevel: maxOptLevel, DisablePasses: []string{stat.Name}}
+		if expected := textSize(t, compile(t, passesProgram, without)) - full; stat.Bytes != expected {
+			t.Errorf("%s: removed %d bytes, expected %d", stat.Name, stat.Bytes, expected)
+		}
+	}
+	if len(names) != len(passes) {
+		t.Errorf("unexpected passes %v, expected all %d passes", names, len(passes))
+	}
+	if stats[0].Name != "fold" || stats[0].Bytes <= 0 {
+		t.Errorf("unexpected first pass stats %+v", stats[0])
+	}
+
+	// Passes not run aren't reported.
+	stats, err = PassStats([]byte(passesProgram), Options{CellBits: 8, OptLevel: 1, DisablePasses: []string{"fold"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled []string
+	for _, stat := range stats {
+		enabled = append(enabled, stat.Name)
+	}
+	if !reflect.DeepEqual(enabled, []string{"clear-loops", "dead-loops"}) {
+		t.Errorf("unexpected passes %v at -O1 without fold", enabled)
+	}
+}
+
+// textSize returns the size of the .text section of the executable.
+func textSize(t *testing.T, binary []byte) int {
+	t.Helper()
+
+	f, err := elf.NewFile(bytes.NewReader(binary))
+	if err != nil {
+		t.Fatal(err)
+	}
+	text := f.Section(".text")
+	if text == nil {
+		t.Fatal("no .text section")
+	}
+	return int(text.Size)
+}
@@ -0,0 +1,161 @@
+package x64_encoding
+
+import "fmt"
+
+// Op is the operation of an Instr.
+type Op int
+
+const (
+	OpMov Op = iota + 1
+	OpInc
+	OpDec
+	OpAdd
+	OpSub
+	OpCmp
+	OpTest
+)
+
+var opNames = [...]string{
+	OpMov:  "mov",
+	OpInc:  "inc",
+	OpDec:  "dec",
+	OpAdd:  "add",
+	OpSub:  "sub",
+	OpCmp:  "cmp",
+	OpTest: "test",
+}
+
+func (op Op) String() string {
+	if op > 0 && int(op) < len(opNames) {
+		return opNames[op]
+	}
+	return fmt.Sprintf("op(%d)", int(op))
+}
+
+// OperandKind is what an Operand refers to.
+type OperandKind int
+
+const (
+	NoOperand OperandKind = iota
+	RegisterOperand
+	MemoryOperand
+	ImmediateOperand
+)
+
+// Operand is an operand of an Instr.
+type Operand struct {
+	Kind         OperandKind
+	Reg          Register // The register, or the base register for memory.
+	Displacement int32    // For memory.
+	Imm          uint32   // For immediates.
+}
+
+// Reg returns a register operand.
+func Reg(r Register) Operand {
+	return Operand{Kind: RegisterOperand, Reg: r}
+}
+
+// Mem returns an operand for the memory at base plus displacement.
+func Mem(base Register, displacement int32) Operand {
+	return Operand{Kind: MemoryOperand, Reg: base, Displacement: displacement}
+}
+
+// Imm returns an immediate operand.
+func Imm(imm uint32) Operand {
+	return Operand{Kind: ImmediateOperand, Imm: imm}
+}
+
+func (o Operand) String() string {
+	switch o.Kind {
+	case RegisterOperand:
+		return fmt.Sprintf("r%d", o.Reg)
+	case MemoryOperand:
+		return fmt.Sprintf("[r%d%+d]", o.Reg, o.Displacement)
+	case ImmediateOperand:
+		return fmt.Sprintf("%#x", o.Imm)
+	}
+	return "none"
+}
+
+// Instr is an instruction before it is encoded. Only the instructions
+// the peephole optimiser needs to know the effects of are emitted as an
+// Instr, everything else is encoded straight into the output.
+type Instr struct {
+	Op   Op
+	Size Size // Operand size, Qword for moves between registers.
+	Dst  Operand
+	Src  Operand // NoOperand for inc and dec.
+}
+
+func (in Instr) String() string {
+	if in.Src.Kind == NoOperand {
+		return fmt.Sprintf("%s%d %s", in.Op, in.Size*8, in.Dst)
+	}
+	return fmt.Sprintf("%s%d %s, %s", in.Op, in.Size*8, in.Dst, in.Src)
+}
+
+// Emit emits the instruction, unless the peephole optimiser finds that
+// it is redundant.
+func (b *Builder) Emit(in Instr) {
+	if b.Peephole {
+		if b.windowEnd != len(b.output) {
+			// Something other than an Instr was emitted since the
+			// last one.
+			b.window = b.window[:0]
+		}
+		if b.redundant(in) {
+			return
+		}
+	}
+	b.encode(in)
+	if b.Peephole {
+		if len(b.window) == windowSize {
+			copy(b.window, b.window[1:])
+			b.window = b.window[:windowSize-1]
+		}
+		b.window = append(b.window, in)
+		b.windowEnd = len(b.output)
+	}
+}
+
+// encode encodes the instruction into the output.
+func (b *Builder) encode(in Instr) {
+	dst, src := in.Dst, in.Src
+	switch {
+	case in.Op == OpMov && dst.Kind == RegisterOperand && src.Kind == RegisterOperand && in.Size == Qword:
+		b.encodeMovRegReg(dst.Reg, src.Reg)
+	case in.Op == OpMov && dst.Kind == MemoryOperand && src.Kind == RegisterOperand:
+		b.encodeMovMemReg(in.Size, dst.Reg, src.Reg, dst.Displacement)
+	case (in.Op == OpInc || in.Op == OpDec) && dst.Kind == RegisterOperand:
+		b.encodeIncDecReg(in.Size, incDecExt(in.Op), dst.Reg)
+	case (in.Op == OpInc || in.Op == OpDec) && dst.Kind == MemoryOperand:
+		b.encodeIncDecMem(in.Size, incDecExt(in.Op), dst.Reg, dst.Displacement)
+	case (in.Op == OpAdd || in.Op == OpSub) && dst.Kind == RegisterOperand && src.Kind == ImmediateOperand:
+		b.encodeArithRegImm(in.Size, arithExt(in.Op), dst.Reg, src.Imm)
+	case (in.Op == OpAdd || in.Op == OpSub) && dst.Kind == MemoryOperand && src.Kind == ImmediateOperand:
+		b.emitArithMemImm(in.Size, arithExt(in.Op), dst.Reg, dst.Displacement, src.Imm)
+	case in.Op == OpCmp && dst.Kind == MemoryOperand && src.Kind == ImmediateOperand:
+		b.encodeCmpMemImm(in.Size, dst.Reg, dst.Displacement, src.Imm)
+	case in.Op == OpTest && dst.Kind == RegisterOperand && src.Kind == RegisterOperand:
+		b.encodeTestRegReg(in.Size, dst.Reg, src.Reg)
+	default:
+		panic(fmt.Sprintf("unable to encode %s", in))
+	}
+}
+
+// incDecExt returns the opcode extension of an inc or dec.
+func incDecExt(op Op) byte {
+	if op == OpDec {
+		return 1
+	}
+	return 0
+}
+
+// arithExt returns the opcode extension of an add or sub with an
+// immediate source.
+func arithExt(op Op) byte {
+	if op == OpSub {
+		return 5
+	}
+	return 0
+}
@@ -0,0 +1,74 @@
+package x64_encoding
+
+// Number of previous instructions the peephole optimiser looks at.
+const windowSize = 8
+
+// redundant returns true if the instruction has no effect given the
+// instructions in the window, which were emitted one after the other
+// straight before it.
+func (b *Builder) redundant(in Instr) bool {
+	switch {
+	case in.Op == OpMov && in.Dst.Kind == RegisterOperand && in.Src.Kind == RegisterOperand:
+		if in.Dst.Reg == in.Src.Reg {
+			return true
+		}
+		// The registers already hold the same value if one was
+		// moved to the other, and neither has changed since. eg:
+		// `mov rax, r14 ; mov r14, rax`.
+		for i := len(b.window) - 1; i >= 0; i-- {
+			prev := b.window[i]
+			if prev.Op == OpMov && prev.Src.Kind == RegisterOperand &&
+				(prev.Dst == in.Dst && prev.Src == in.Src || prev.Dst == in.Src && prev.Src == in.Dst) {
+				return true
+			}
+			if prev.writes(in.Dst, in.Size) || prev.writes(in.Src, in.Size) {
+				return false
+			}
+		}
+	case in.Op == OpCmp && in.Src == Imm(0), in.Op == OpTest && in.Dst == in.Src:
+		// A compare against zero only sets the flags from its
+		// operand, which are already set if the last instruction to
+		// set the flags was the same compare or changed the same
+		// operand. eg: `dec byte [rax] ; cmp byte [rax], 0`.
+		for i := len(b.window) - 1; i >= 0; i-- {
+			prev := b.window[i]
+			if prev.setsFlags() {
+				if prev == in {
+					return true
+				}
+				return prev.Op != OpCmp && prev.Op != OpTest && prev.Size == in.Size && prev.Dst == in.Dst
+			}
+			if prev.writes(in.Dst, in.Size) {
+				return false
+			}
+		}
+	}
+	return false
+}
+
+// setsFlags returns true if the instruction changes the flags.
+func (in Instr) setsFlags() bool {
+	return in.Op != OpMov
+}
+
+// writes returns true if the instruction may change the value of the
+// operand, which is size bytes for memory.
+func (in Instr) writes(o Operand, size Size) bool {
+	if in.Op == OpCmp || in.Op == OpTest || o.Kind == NoOperand || o.Kind == ImmediateOperand {
+		return false
+	}
+	dst := in.Dst
+	switch {
+	case dst.Kind == RegisterOperand:
+		// Changing the base register of memory changes which
+		// memory it is.
+		return dst.Reg == o.Reg
+	case dst.Kind == MemoryOperand && o.Kind == MemoryOperand:
+		if dst.Reg != o.Reg {
+			// Could still be the same memory.
+			return true
+		}
+		return o.Displacement < dst.Displacement+int32(in.Size) && dst.Displacement < o.Displacement+int32(size)
+	}
+	return false
+}
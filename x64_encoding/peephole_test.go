@@ -0,0 +1,229 @@
+package x64_encoding
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPeephole(t *testing.T) {
+	tests := []struct {
+		name     string
+		emit     func(b *Builder)
+		expected func(b *Builder) // Emitted without the peephole optimiser.
+	}{
+		{
+			"move back",
+			func(b *Builder) {
+				b.EmitMovRegReg(R14, RAX)
+				b.EmitMovRegReg(RAX, R14)
+			},
+			func(b *Builder) {
+				b.EmitMovRegReg(R14, RAX)
+			},
+		},
+		{
+			"move to itself",
+			func(b *Builder) {
+				b.EmitMovRegReg(RAX, RAX)
+			},
+			func(b *Builder) {},
+		},
+		{
+			"moves around calls",
+			func(b *Builder) {
+				b.EmitMovRegReg(R14, RAX)
+				b.EmitCall(0)
+				b.EmitMovRegReg(RAX, R14)
+				b.EmitMovRegReg(R14, RAX)
+				b.EmitCall(0)
+				b.EmitMovRegReg(RAX, R14)
+			},
+			func(b *Builder) {
+				b.EmitMovRegReg(R14, RAX)
+				b.EmitCall(0)
+				b.EmitMovRegReg(RAX, R14)
+				b.EmitCall(0)
+				b.EmitMovRegReg(RAX, R14)
+			},
+		},
+		{
+			"moved register changed",
+			func(b *Builder) {
+				b.EmitMovRegReg(R14, RAX)
+				b.EmitAddRegImm(RAX, 1)
+				b.EmitMovRegReg(R14, RAX)
+			},
+			func(b *Builder) {
+				b.EmitMovRegReg(R14, RAX)
+				b.EmitAddRegImm(RAX, 1)
+				b.EmitMovRegReg(R14, RAX)
+			},
+		},
+		{
+			"compare after dec",
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+			},
+		},
+		{
+			"compare after dec of a different size",
+			func(b *Builder) {
+				b.EmitDecMemSize(Word, RAX, 0)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitDecMemSize(Word, RAX, 0)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+		},
+		{
+			"compare against non-zero",
+			func(b *Builder) {
+				b.EmitAddMemImmSize(Byte, RAX, 0, 2)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 1)
+			},
+			func(b *Builder) {
+				b.EmitAddMemImmSize(Byte, RAX, 0, 2)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 1)
+			},
+		},
+		{
+			"test after store",
+			func(b *Builder) {
+				b.EmitSubRegImmSize(Byte, R13, 3)
+				b.EmitMovMemRegSize(Byte, RAX, R13, 0)
+				b.EmitTestRegRegSize(Byte, R13, R13)
+			},
+			func(b *Builder) {
+				b.EmitSubRegImmSize(Byte, R13, 3)
+				b.EmitMovMemRegSize(Byte, RAX, R13, 0)
+			},
+		},
+		{
+			"compare after store to another cell",
+			func(b *Builder) {
+				b.EmitIncMemSize(Word, RAX, 2)
+				b.EmitMovMemRegSize(Word, RAX, R13, 0)
+				b.EmitMovMemRegSize(Word, RAX, R13, 4)
+				b.EmitCmpMemImmSize(Word, RAX, 2, 0)
+			},
+			func(b *Builder) {
+				b.EmitIncMemSize(Word, RAX, 2)
+				b.EmitMovMemRegSize(Word, RAX, R13, 0)
+				b.EmitMovMemRegSize(Word, RAX, R13, 4)
+			},
+		},
+		{
+			"compare after store to the same cell",
+			func(b *Builder) {
+				b.EmitIncMemSize(Word, RAX, 2)
+				b.EmitMovMemRegSize(Byte, RAX, R13, 3)
+				b.EmitCmpMemImmSize(Word, RAX, 2, 0)
+			},
+			func(b *Builder) {
+				b.EmitIncMemSize(Word, RAX, 2)
+				b.EmitMovMemRegSize(Byte, RAX, R13, 3)
+				b.EmitCmpMemImmSize(Word, RAX, 2, 0)
+			},
+		},
+		{
+			"compare after store to other memory",
+			func(b *Builder) {
+				b.EmitIncMemSize(Byte, RAX, 0)
+				b.EmitMovMemRegSize(Byte, RDI, RDX, 0)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitIncMemSize(Byte, RAX, 0)
+				b.EmitMovMemRegSize(Byte, RDI, RDX, 0)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+		},
+		{
+			"compare after moving the tape pointer",
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.EmitAddRegImm(RAX, 1)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.EmitAddRegImm(RAX, 1)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+		},
+		{
+			"compare twice",
+			func(b *Builder) {
+				b.EmitCmpMemImmSize(Qword, RAX, 8, 0)
+				b.EmitCmpMemImmSize(Qword, RAX, 8, 0)
+			},
+			func(b *Builder) {
+				b.EmitCmpMemImmSize(Qword, RAX, 8, 0)
+			},
+		},
+		{
+			// The cmp is needed when the je is taken, as the flags
+			// are from before the jump rather than from the dec.
+			"compare at a forward jump target",
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				addrID := b.EmitJeqNotYetDefined()
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.CompleteJeq(addrID, int32(len(b.output)))
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				addrID := b.EmitJeqNotYetDefined()
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.CompleteJeq(addrID, int32(len(b.output)))
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+		},
+		{
+			"compare at a forward jcc target",
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				addrID := b.EmitJccNotYetDefined(CondNE)
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.CompleteJcc(addrID, int32(len(b.output)))
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				addrID := b.EmitJccNotYetDefined(CondNE)
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.CompleteJcc(addrID, int32(len(b.output)))
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+		},
+		{
+			"compare at a label",
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.CurrentOffset()
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+			func(b *Builder) {
+				b.EmitDecMemSize(Byte, RAX, 0)
+				b.EmitCmpMemImmSize(Byte, RAX, 0, 0)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		b := NewBuilder()
+		b.Peephole = true
+		tt.emit(b)
+		expected := NewBuilder()
+		tt.expected(expected)
+		if !bytes.Equal(b.output, expected.output) {
+			t.Errorf("%s: unexpected generated output %s, expected %s", tt.name, b.hex(), expected.hex())
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 
+	"github.com/vishen/go-brainfunk/dwarf"
 	"github.com/vishen/go-brainfunk/elf"
 )
 
@@ -43,14 +44,95 @@ const (
 	RegNull = RAX // This is used as a replacement for op2 for 1 operand instructions.
 )
 
+// dwarfRegisters are the numbers DWARF uses for the registers, which
+// aren't in the same order as their encodings.
+var dwarfRegisters = [...]int{
+	RAX: 0, RDX: 1, RCX: 2, RBX: 3, RSI: 4, RDI: 5, RBP: 6, RSP: 7,
+	R8: 8, R9: 9, R10: 10, R11: 11, R12: 12, R13: 13, R14: 14, R15: 15,
+}
+
+// DWARFNumber returns the number of the register in DWARF location
+// expressions.
+func (r Register) DWARFNumber() int {
+	return dwarfRegisters[r]
+}
+
+// XMMRegister is one of the 128-bit SSE registers.
+type XMMRegister int8
+
+func (r XMMRegister) Reg() byte {
+	return byte(r & 7)
+}
+
+const (
+	XMM0 XMMRegister = iota
+	XMM1
+	XMM2
+	XMM3
+	XMM4
+	XMM5
+	XMM6
+	XMM7
+	XMM8
+	XMM9
+	XMM10
+	XMM11
+	XMM12
+	XMM13
+	XMM14
+	XMM15
+)
+
+// Condition is the condition code for a conditional jump, it is
+// added to the base opcode of the jcc instruction.
+type Condition byte
+
+const (
+	CondB  Condition = 0x2 // Below, unsigned <
+	CondAE Condition = 0x3 // Above or equal, unsigned >=
+	CondE  Condition = 0x4 // Equal
+	CondNE Condition = 0x5 // Not equal
+	CondBE Condition = 0x6 // Below or equal, unsigned <=
+	CondA  Condition = 0x7 // Above, unsigned >
+)
+
+// Size is the operand size of an instruction in bytes.
+type Size int
+
+const (
+	Byte  Size = 1
+	Word  Size = 2
+	Dword Size = 4
+	Qword Size = 8
+)
+
 type Builder struct {
-	output         []byte
-	currentBssSize uint32
+	output          []byte
+	currentBssSize  uint64
+	data            []byte // Initial contents of the start of the .data segment.
+	currentDataSize uint64
 
 	elfB *elf.Builder
 
 	addrID                int
 	addrIDToIndexInOutput map[int]int
+
+	entry int32 // Offset in the output the program starts at.
+
+	// Debug is the debug information added to the executable, or nil
+	// to leave it out. Its line table is filled in by SetSourcePos and
+	// its address range when the executable is built.
+	Debug *dwarf.Unit
+
+	// Peephole drops instructions emitted with Emit that are
+	// redundant given the instructions straight before them, eg: a
+	// compare against zero of a cell that was just decremented. Only
+	// the zero and sign flags are kept the same when a compare is
+	// dropped, so the flags of a compare against zero must only be
+	// used by je, jne, js or jns.
+	Peephole  bool
+	window    []Instr // Instructions emitted since the last label or instruction that isn't an Instr.
+	windowEnd int     // Length of the output after the last instruction in window.
 }
 
 func NewBuilder() *Builder {
@@ -60,19 +142,128 @@ func NewBuilder() *Builder {
 	}
 }
 
-func (b *Builder) Build() []byte {
-	return b.elfB.Build(b.output, b.currentBssSize)
+func (b *Builder) Build() ([]byte, error) {
+	b.elfB.SetEntry(b.TextAddr(b.entry))
+	b.elfB.AddSymbol(elf.Symbol{
+		Name:   "_start",
+		Type:   elf.SymbolFunction,
+		Global: true,
+		Addr:   b.TextAddr(b.entry),
+		Size:   uint64(int32(len(b.output)) - b.entry),
+	})
+	if b.Debug != nil {
+		b.Debug.LowPC, b.Debug.HighPC = b.TextAddr(0), b.TextAddr(int32(len(b.output)))
+		for _, s := range b.Debug.Sections() {
+			b.elfB.AddSection(s.Name, s.Data)
+		}
+	}
+	return b.elfB.Build(b.output, b.currentBssSize, b.data, b.currentDataSize)
 }
 
+// CurrentOffset returns the offset of the next instruction. The offset
+// could be used as a jump target, so the peephole optimiser never looks
+// at instructions before it.
 func (b *Builder) CurrentOffset() int32 {
+	b.window = b.window[:0]
 	return int32(len(b.output))
 }
 
-func (b *Builder) BssAdd(size uint32) uint32 {
+// SetPIE makes the executable position independent, so that it can be
+// loaded at any address. It has to be set before any addresses are
+// used, and the code must only use addresses with EmitLeaRegRip.
+func (b *Builder) SetPIE(pie bool) {
+	b.elfB.PIE = pie
+}
+
+// BssAdd reserves size bytes of zeroed memory in the .bss segment and
+// returns the virtual address of the start of the reserved memory.
+func (b *Builder) BssAdd(size uint64) uint64 {
 	addr := b.currentBssSize + b.elfB.BssStartAddr()
 	b.currentBssSize += size
 	return addr
+}
 
+// DataAdd reserves size bytes of memory in the .data segment, which
+// starts off with the bytes of data and is zeroed after them, and
+// returns the virtual address of the start of the reserved memory.
+func (b *Builder) DataAdd(data []byte, size uint64) uint64 {
+	addr := b.currentDataSize + b.elfB.DataStartAddr()
+	if len(data) > 0 {
+		b.data = append(b.data, make([]byte, b.currentDataSize-uint64(len(b.data)))...)
+		b.data = append(b.data, data...)
+	}
+	b.currentDataSize += size
+	return addr
+}
+
+// SetEntry sets the offset in the output that the program starts at,
+// which is named _start in the symbol table. The program starts at the
+// start of the output by default.
+func (b *Builder) SetEntry(offset int32) {
+	b.entry = offset
+}
+
+// AddFunction adds a symbol to the symbol table for the function
+// from offset to the current offset.
+func (b *Builder) AddFunction(name string, offset int32) {
+	b.elfB.AddSymbol(elf.Symbol{
+		Name: name,
+		Type: elf.SymbolFunction,
+		Addr: b.TextAddr(offset),
+		Size: uint64(int32(len(b.output)) - offset),
+	})
+}
+
+// AddLabel adds a symbol to the symbol table for offset in the output.
+// The offset could be jumped to, so the peephole optimiser doesn't look
+// at instructions before it.
+func (b *Builder) AddLabel(name string, offset int32) {
+	b.window = b.window[:0]
+	b.elfB.AddSymbol(elf.Symbol{Name: name, Type: elf.SymbolLabel, Addr: b.TextAddr(offset)})
+}
+
+// AddObject adds a symbol to the symbol table for size bytes of data at
+// the virtual address addr, eg: memory reserved with BssAdd.
+func (b *Builder) AddObject(name string, addr, size uint64) {
+	b.elfB.AddSymbol(elf.Symbol{Name: name, Type: elf.SymbolObject, Addr: addr, Size: size})
+}
+
+// SetSourcePos sets the line and column in the source that the
+// instructions emitted after it come from, for the line table of the
+// debug information. Line 0 is for instructions that don't come from
+// anywhere in the source.
+func (b *Builder) SetSourcePos(line, column int) {
+	if b.Debug == nil {
+		return
+	}
+	row := dwarf.Line{Addr: b.TextAddr(int32(len(b.output))), Line: line, Column: column}
+	lines := b.Debug.Lines
+	// Nothing was emitted for the last position if it is at the same
+	// address, so it is replaced.
+	if n := len(lines); n > 0 && lines[n-1].Addr == row.Addr {
+		lines = lines[:n-1]
+	}
+	if n := len(lines); n > 0 && lines[n-1].Line == line && lines[n-1].Column == column {
+		b.Debug.Lines = lines
+		return
+	}
+	b.Debug.Lines = append(lines, row)
+}
+
+// TextAddr returns the virtual address of offset in the output.
+func (b *Builder) TextAddr(offset int32) uint64 {
+	return b.elfB.TextStartAddr() + uint64(offset)
+}
+
+// EmitBytes adds raw data, eg: strings, to the output and returns the
+// offset of the data. The data must never be executed. It is named in
+// the symbol table as an object, so that disassemblers show it as data
+// rather than decoding it as instructions.
+func (b *Builder) EmitBytes(name string, data []byte) int32 {
+	offset := b.CurrentOffset()
+	b.output = append(b.output, data...)
+	b.AddObject(name, b.TextAddr(offset), uint64(len(data)))
+	return offset
 }
 
 func (b *Builder) hex() string {
@@ -97,29 +288,86 @@ func (b *Builder) emitREX(operand64Bit, regExt, sibIndexExt, rmExt bool) {
 	b.output = append(b.output, rex)
 }
 
+// emitSizePrefixes emits the operand-size prefix and REX prefix (if
+// either is needed) for an instruction operating on size bytes, where
+// reg is the register in MODRM.reg and rm the register in MODRM.rm.
+// byteReg should be set when reg is used as an 8-bit register, since
+// SPL, BPL, SIL and DIL can only be encoded with a REX prefix.
+func (b *Builder) emitSizePrefixes(size Size, reg, rm Register, byteReg bool) {
+	if size == Word {
+		// 66	Operand-size override prefix, 16-bit operands.
+		b.output = append(b.output, 0x66)
+	}
+	if size == Qword || reg.IsExt() || rm.IsExt() || (byteReg && size == Byte && reg >= RSP) {
+		b.emitREX(size == Qword, reg.IsExt(), false, rm.IsExt())
+	}
+}
+
+// emitRegSizePrefixes is emitSizePrefixes for an instruction with a
+// register in MODRM.rm rather than memory, where either register can
+// be SPL, BPL, SIL or DIL.
+func (b *Builder) emitRegSizePrefixes(size Size, reg, rm Register) {
+	if size == Byte && rm >= RSP && !rm.IsExt() && !reg.IsExt() {
+		b.emitREX(false, false, false, false)
+		return
+	}
+	b.emitSizePrefixes(size, reg, rm, true)
+}
+
 func (b *Builder) emitModRM(mod byte, reg byte, rm byte) {
 	var modrm byte = 0x0
 	modrm |= (rm | (reg << 3) | (mod << 6))
 	b.output = append(b.output, modrm)
 }
 
-func (b *Builder) emitModRMWithDisplacement(op1 byte, op2 byte, displacement uint32) {
-	if displacement < 128 {
+func (b *Builder) emitModRMWithDisplacement(op1 byte, op2 byte, displacement int32) {
+	// The displacement is sign extended, so negative displacements
+	// down to -128 also fit in a byte.
+	if displacement >= -128 && displacement <= 127 {
 		b.emitModRM(0x01, op2, op1)
+		b.emitSIBForBase(op1)
 		b.output = append(b.output, uint8(displacement))
 	} else {
 		b.emitModRM(0x02, op2, op1)
+		b.emitSIBForBase(op1)
 		// TODO: This seems like an inconvienient way to do this?
 		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, displacement)
+		binary.LittleEndian.PutUint32(buf, uint32(displacement))
 		b.output = append(b.output, buf...)
 	}
 }
 
+// emitModRMMem emits the ModRM byte for the memory operand at the base
+// register op1 plus displacement, which is left out when it is 0. With
+// no displacement RBP and R13 as op1 mean RIP relative instead, so they
+// always get a disp8 of 0.
+func (b *Builder) emitModRMMem(op1 byte, op2 byte, displacement int32) {
+	if displacement == 0 && op1 != 0x05 {
+		b.emitModRM(0x00, op2, op1)
+		b.emitSIBForBase(op1)
+	} else {
+		b.emitModRMWithDisplacement(op1, op2, displacement)
+	}
+}
+
+// emitSIBForBase emits the SIB byte needed after a ModRM byte with the
+// memory operand op1. An op1 of RSP or R12 means a SIB byte follows, so
+// they are encoded as a SIB byte with them as the base and no index.
+func (b *Builder) emitSIBForBase(op1 byte) {
+	if op1 == 0x04 {
+		b.output = append(b.output, 0x24)
+	}
+}
+
 func (b *Builder) EmitInt(imm byte) {
 	b.output = append(b.output, 0xcd, imm)
 }
 
+func (b *Builder) EmitSyscall() {
+	// 0F 05	SYSCALL, clobbers RCX and R11.
+	b.output = append(b.output, 0x0f, 0x05)
+}
+
 func (b *Builder) EmitJeqNotYetDefined() int {
 	b.addrID += 1
 	index := len(b.output)
@@ -134,30 +382,36 @@ func (b *Builder) EmitNop() {
 	b.output = append(b.output, 0x90)
 }
 
-func (b *Builder) CompleteJeq(addrID int, offset int32, length int) {
+// CompleteJeq fills in the je emitted by EmitJeqNotYetDefined so that
+// it jumps to offset. The short encoding is used when offset is in
+// range of it.
+func (b *Builder) CompleteJeq(addrID int, offset int32) {
+	// The flags at offset also depend on where the jump came from.
+	b.window = b.window[:0]
 	jeqOffset := b.addrIDToIndexInOutput[addrID]
-	jumpToOffset := (int(offset)) - (jeqOffset + length) // TODO: Offset This doesn't need to be int32...
 	var output []byte
-	if jumpToOffset >= -128 && jumpToOffset <= 127 {
-		// jumpToOffset += 2 // Length of the jump instruction
+	// The jump is relative to the end of the je instruction, which is
+	// 2 bytes long for the short encoding and 6 bytes for the long.
+	if jumpToOffset := int(offset) - (jeqOffset + 2); jumpToOffset >= -128 && jumpToOffset <= 127 {
 		output = []byte{0x74, byte(jumpToOffset)}
 	} else {
 		output = []byte{0x0F, 0x10 + 0x74}
 		buf := make([]byte, 4)
-		// NOTE: This magic 6 is the length of this encoding. The
-		// jump offset needs to be AFTER the command has executed.
-		// jumpToOffset += 6 // Length of the jump instruction.
-		// x := uint32(0xffffffff) - uint32(jumpToOffset-1)
-		binary.LittleEndian.PutUint32(buf, uint32(jumpToOffset))
+		binary.LittleEndian.PutUint32(buf, uint32(int(offset)-(jeqOffset+6)))
 		output = append(output, buf...)
 	}
-	// TODO: Fix offset being int32!
 	for i := 0; i < len(output); i++ {
 		b.output[jeqOffset+i] = output[i]
 	}
 }
 
 func (b *Builder) EmitJneBack(offset int32) int {
+	return b.EmitJccBack(CondNE, offset)
+}
+
+// EmitJccBack emits a conditional jump back to offset, and returns the
+// length of the emitted jump instruction.
+func (b *Builder) EmitJccBack(cond Condition, offset int32) int {
 	/*
 		// http://blog.jeff.over.bz/assembly/compilers/jit/2017/01/15/x86-assembler.html
 		uint8_t *jcc_mnemonic(int32_t bytes, uint8_t *buf) {
@@ -177,11 +431,13 @@ func (b *Builder) EmitJneBack(offset int32) int {
 	// instruction and the offset
 	jumpToOffset := int32(len(b.output)) - offset
 	outputBefore := len(b.output)
-	if jumpToOffset >= -128 && jumpToOffset <= 127 {
+	// The rel8 is relative to the end of the 2 byte jump, so the
+	// distance it can reach backwards is 126 bytes, not 128.
+	if jumpToOffset+2 <= 128 {
 		jumpToOffset += 2 // Length of the jump instruction
-		b.output = append(b.output, 0x75, byte(0xff-(jumpToOffset-1)))
+		b.output = append(b.output, 0x70+byte(cond), byte(0xff-(jumpToOffset-1)))
 	} else {
-		b.output = append(b.output, 0x0F, 0x10+0x75)
+		b.output = append(b.output, 0x0F, 0x80+byte(cond))
 		buf := make([]byte, 4)
 		// NOTE: This magic 6 is the length of this encoding. The
 		// jump offset needs to be AFTER the command has executed.
@@ -197,6 +453,23 @@ func (b *Builder) EmitJmpForwardRelative(offset int32) {
 	b.output = append(b.output, 0xeb, byte(b.CurrentOffset()+offset))
 }
 
+func (b *Builder) EmitJccNotYetDefined(cond Condition) int {
+	b.addrID += 1
+	b.addrIDToIndexInOutput[b.addrID] = len(b.output)
+	// 0F 80+cc cd	Jcc rel32, the displacement is filled in by CompleteJcc.
+	b.output = append(b.output, 0x0f, 0x80+byte(cond), 0x00, 0x00, 0x00, 0x00)
+	return b.addrID
+}
+
+// CompleteJcc fills in the jump emitted by EmitJccNotYetDefined so that
+// it jumps to offset.
+func (b *Builder) CompleteJcc(addrID int, offset int32) {
+	b.window = b.window[:0]
+	jccOffset := b.addrIDToIndexInOutput[addrID]
+	// The jump is relative to the end of the 6 byte jcc instruction.
+	binary.LittleEndian.PutUint32(b.output[jccOffset+2:], uint32(int(offset)-(jccOffset+6)))
+}
+
 func (b *Builder) EmitCall(offset int32) {
 	// two's complement of the distance between the current
 	// instruction and the offset
@@ -210,27 +483,65 @@ func (b *Builder) EmitCall(offset int32) {
 }
 
 func (b *Builder) EmitIncReg(src Register) {
-	b.emitREX(true, false, false, src.IsExt())
-	b.output = append(b.output, 0xFF)
-	b.emitModRM(0x03, 0, src.Reg())
+	b.EmitIncRegSize(Qword, src)
 }
 
-func (b *Builder) EmitIncMem(src Register, displacement uint32) {
-	b.emitREX(true, false, false, src.IsExt())
-	b.output = append(b.output, 0xFF)
-	b.emitModRMWithDisplacement(src.Reg(), 0, displacement)
+// EmitIncRegSize emits an inc of the low size bytes of src.
+func (b *Builder) EmitIncRegSize(size Size, src Register) {
+	b.Emit(Instr{Op: OpInc, Size: size, Dst: Reg(src)})
+}
+
+// encodeIncDecReg encodes an inc (ext 0) or dec (ext 1) of the low size
+// bytes of src.
+func (b *Builder) encodeIncDecReg(size Size, ext byte, src Register) {
+	b.emitRegSizePrefixes(size, RegNull, src)
+	if size == Byte {
+		// FE /0 or /1	INC or DEC r/m8
+		b.output = append(b.output, 0xFE)
+	} else {
+		// FF /0 or /1	INC or DEC r/m16, r/m32 or r/m64
+		b.output = append(b.output, 0xFF)
+	}
+	b.emitModRM(0x03, ext, src.Reg())
+}
+
+func (b *Builder) EmitIncMem(src Register, displacement int32) {
+	b.EmitIncMemSize(Qword, src, displacement)
+}
+
+func (b *Builder) EmitIncMemSize(size Size, src Register, displacement int32) {
+	b.Emit(Instr{Op: OpInc, Size: size, Dst: Mem(src, displacement)})
+}
+
+// encodeIncDecMem encodes an inc (ext 0) or dec (ext 1) of the size
+// bytes at src plus displacement.
+func (b *Builder) encodeIncDecMem(size Size, ext byte, src Register, displacement int32) {
+	b.emitSizePrefixes(size, RegNull, src, false)
+	if size == Byte {
+		// FE /0 or /1	INC or DEC r/m8
+		b.output = append(b.output, 0xFE)
+	} else {
+		// FF /0 or /1	INC or DEC r/m16, r/m32 or r/m64
+		b.output = append(b.output, 0xFF)
+	}
+	b.emitModRMWithDisplacement(src.Reg(), ext, displacement)
 }
 
 func (b *Builder) EmitDecReg(src Register) {
-	b.emitREX(true, false, false, src.IsExt())
-	b.output = append(b.output, 0xFF)
-	b.emitModRM(0x03, 0x01, src.Reg())
+	b.EmitDecRegSize(Qword, src)
 }
 
-func (b *Builder) EmitDecMem(src Register, displacement uint32) {
-	b.emitREX(true, false, false, src.IsExt())
-	b.output = append(b.output, 0xFF)
-	b.emitModRMWithDisplacement(src.Reg(), 1, displacement)
+// EmitDecRegSize emits a dec of the low size bytes of src.
+func (b *Builder) EmitDecRegSize(size Size, src Register) {
+	b.Emit(Instr{Op: OpDec, Size: size, Dst: Reg(src)})
+}
+
+func (b *Builder) EmitDecMem(src Register, displacement int32) {
+	b.EmitDecMemSize(Qword, src, displacement)
+}
+
+func (b *Builder) EmitDecMemSize(size Size, src Register, displacement int32) {
+	b.Emit(Instr{Op: OpDec, Size: size, Dst: Mem(src, displacement)})
 }
 
 func (b *Builder) EmitMovRegImm(src Register, imm uint32) {
@@ -243,56 +554,169 @@ func (b *Builder) EmitMovRegImm(src Register, imm uint32) {
 	b.output = append(b.output, buf...)
 }
 
+func (b *Builder) EmitMovRegImm64(src Register, imm uint64) {
+	// REX.W + B8+ rd io	MOV r64, imm64
+	b.emitREX(true, false, false, src.IsExt())
+	b.output = append(b.output, 0xb8+src.Reg())
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, imm)
+	b.output = append(b.output, buf...)
+}
+
+// EmitLeaRegRip emits `lea src, [rip+disp32]`, which sets src to the
+// virtual address addr wherever the executable is loaded, since the
+// displacement is relative to the address of the next instruction.
+func (b *Builder) EmitLeaRegRip(src Register, addr uint64) {
+	// REX.W 8D /r	LEA r64, m
+	b.emitREX(true, src.IsExt(), false, false)
+	b.output = append(b.output, 0x8d)
+	// MODRM.mod 00 with MODRM.rm 101 is [rip+disp32] in 64-bit mode,
+	// rather than [rbp] which needs a displacement instead.
+	b.emitModRM(0x00, src.Reg(), 0x05)
+	next := b.TextAddr(int32(len(b.output)) + 4)
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(addr-next))
+	b.output = append(b.output, buf...)
+}
+
 func (b *Builder) EmitMovRegReg(src, dest Register) {
+	b.Emit(Instr{Op: OpMov, Size: Qword, Dst: Reg(src), Src: Reg(dest)})
+}
+
+func (b *Builder) encodeMovRegReg(src, dest Register) {
 	b.emitREX(true, dest.IsExt(), false, src.IsExt())
 	b.output = append(b.output, 0x89)
 	b.emitModRM(0x3, dest.Reg(), src.Reg())
 }
 
-func (b *Builder) EmitMovMemReg(src, dest Register, displacement uint32) {
-	b.emitREX(true, dest.IsExt(), false, src.IsExt())
-	b.output = append(b.output, 0x89)
-	b.emitModRMWithDisplacement(src.Reg(), dest.Reg(), displacement)
+func (b *Builder) EmitMovMemReg(src, dest Register, displacement int32) {
+	b.EmitMovMemRegSize(Qword, src, dest, displacement)
 }
 
-func (b *Builder) EmitMovRegMem(src, dest Register, displacement uint32) {
-	b.emitREX(true, src.IsExt(), false, dest.IsExt())
-	b.output = append(b.output, 0x8b)
-	if displacement == 0 {
-		b.emitModRM(0x00, src.Reg(), dest.Reg())
+func (b *Builder) EmitMovMemRegSize(size Size, src, dest Register, displacement int32) {
+	b.Emit(Instr{Op: OpMov, Size: size, Dst: Mem(src, displacement), Src: Reg(dest)})
+}
+
+func (b *Builder) encodeMovMemReg(size Size, src, dest Register, displacement int32) {
+	b.emitSizePrefixes(size, dest, src, true)
+	if size == Byte {
+		// 88 /r	MOV r/m8, r8
+		b.output = append(b.output, 0x88)
 	} else {
-		b.emitModRMWithDisplacement(dest.Reg(), src.Reg(), displacement)
+		// 89 /r	MOV r/m16, r16 / r/m32, r32 / r/m64, r64
+		b.output = append(b.output, 0x89)
 	}
+	b.emitModRMWithDisplacement(src.Reg(), dest.Reg(), displacement)
 }
 
-// Add instructions
-func (b *Builder) EmitAddRegImm(src Register, imm uint32) {
+func (b *Builder) EmitMovMemImm(src Register, displacement int32, imm uint32) {
+	b.EmitMovMemImmSize(Qword, src, displacement, imm)
+}
 
-	b.emitREX(true, false, false, src.IsExt())
-	// NOTE: src == RAX and imm == 32-bit, then special case
-	if src == RAX && imm >= 128 {
-		// REX.W + 05 id	ADD RAX, imm32
-		b.output = append(b.output, 0x05)
-	} else {
-		if imm < 128 {
-			// REX.W + 83 /0 ib    ADD r/m64, imm8
-			b.output = append(b.output, 0x83)
-		} else {
-			// REX.W + 81 /0 id	ADD r/m64, imm32
-			b.output = append(b.output, 0x81)
-		}
-		b.emitModRM(0x03, 0, src.Reg())
+// EmitMovMemImmSize emits a store of imm to the memory at src plus
+// displacement. The immediate is sign extended for Qword.
+func (b *Builder) EmitMovMemImmSize(size Size, src Register, displacement int32, imm uint32) {
+	b.emitSizePrefixes(size, RegNull, src, false)
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, imm)
+	switch size {
+	case Byte:
+		// C6 /0 ib	MOV r/m8, imm8
+		b.output = append(b.output, 0xC6)
+		buf = buf[:1]
+	case Word:
+		// C7 /0 iw	MOV r/m16, imm16
+		b.output = append(b.output, 0xC7)
+		buf = buf[:2]
+	default:
+		// C7 /0 id	MOV r/m32, imm32 / r/m64, imm32
+		b.output = append(b.output, 0xC7)
 	}
-	// TODO: This is very similar to the displacement checking if
-	// imm8 or imm32, maybe refactor if possible?
-	if imm >= 128 {
-		// TODO: Move to function
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, imm)
-		b.output = append(b.output, buf...)
+	b.emitModRMWithDisplacement(src.Reg(), 0, displacement)
+	b.output = append(b.output, buf...)
+}
+
+func (b *Builder) EmitMovRegMem(src, dest Register, displacement int32) {
+	b.EmitMovRegMemSize(Qword, src, dest, displacement)
+}
+
+// EmitMovRegMemSize loads size bytes from memory into the low bytes of
+// src. As usual for x64, a Dword load zeroes the upper 32 bits of src
+// while Byte and Word loads leave the upper bits unchanged.
+func (b *Builder) EmitMovRegMemSize(size Size, src, dest Register, displacement int32) {
+	b.emitSizePrefixes(size, src, dest, true)
+	if size == Byte {
+		// 8A /r	MOV r8, r/m8
+		b.output = append(b.output, 0x8a)
 	} else {
+		// 8B /r	MOV r16, r/m16 / r32, r/m32 / r64, r/m64
+		b.output = append(b.output, 0x8b)
+	}
+	b.emitModRMMem(dest.Reg(), src.Reg(), displacement)
+}
+
+// EmitMovzxRegMemSize emits a load of the size bytes at dest plus
+// displacement into the 64-bit register src, zero extending the
+// value. Dword loads are zero extended by a plain mov.
+func (b *Builder) EmitMovzxRegMemSize(size Size, src, dest Register, displacement int32) {
+	switch size {
+	case Byte:
+		// REX.W + 0F B6 /r	MOVZX r64, r/m8
+		b.emitREX(true, src.IsExt(), false, dest.IsExt())
+		b.output = append(b.output, 0x0f, 0xb6)
+	case Word:
+		// REX.W + 0F B7 /r	MOVZX r64, r/m16
+		b.emitREX(true, src.IsExt(), false, dest.IsExt())
+		b.output = append(b.output, 0x0f, 0xb7)
+	default:
+		b.EmitMovRegMemSize(size, src, dest, displacement)
+		return
+	}
+	b.emitModRMWithDisplacement(dest.Reg(), src.Reg(), displacement)
+}
+
+func (b *Builder) EmitAddRegImm(src Register, imm uint32) {
+	b.EmitAddRegImmSize(Qword, src, imm)
+}
+
+// EmitAddRegImmSize emits an add of imm to the low size bytes of src.
+// The immediate is sign extended for Qword.
+func (b *Builder) EmitAddRegImmSize(size Size, src Register, imm uint32) {
+	b.Emit(Instr{Op: OpAdd, Size: size, Dst: Reg(src), Src: Imm(imm)})
+}
+
+// encodeArithRegImm encodes the arithmetic instruction selected by the
+// opcode extension ext (eg: 0 for add, 5 for sub) with a register
+// destination and an immediate source.
+func (b *Builder) encodeArithRegImm(size Size, ext byte, src Register, imm uint32) {
+	b.emitRegSizePrefixes(size, RegNull, src)
+	switch {
+	case size == Byte:
+		// 80 /ext ib	OP r/m8, imm8
+		b.output = append(b.output, 0x80)
+		b.emitModRM(0x03, ext, src.Reg())
 		b.output = append(b.output, uint8(imm))
+		return
+	case imm < 128:
+		// 83 /ext ib	OP r/m16, r/m32 or r/m64, imm8
+		b.output = append(b.output, 0x83)
+		b.emitModRM(0x03, ext, src.Reg())
+		b.output = append(b.output, uint8(imm))
+		return
+	case src == RAX && size != Word:
+		// 05 id or 2D id	ADD or SUB EAX or RAX, imm32
+		b.output = append(b.output, 0x05|ext<<3)
+	default:
+		// 81 /ext iw or id	OP r/m16, imm16 / r/m32, imm32 / r/m64, imm32
+		b.output = append(b.output, 0x81)
+		b.emitModRM(0x03, ext, src.Reg())
 	}
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, imm)
+	if size == Word {
+		buf = buf[:2]
+	}
+	b.output = append(b.output, buf...)
 }
 
 func (b *Builder) EmitAddRegReg(src, dest Register) {
@@ -302,60 +726,80 @@ func (b *Builder) EmitAddRegReg(src, dest Register) {
 	b.emitModRM(0x3, dest.Reg(), src.Reg())
 }
 
-func (b *Builder) EmitAddMemReg(src, dest Register, displacement uint32) {
-	b.emitREX(true, dest.IsExt(), false, src.IsExt())
-	// REX.W + 01 /r	ADD r/m64, r64
-	b.output = append(b.output, 0x01)
-	if displacement == 0 {
-		b.emitModRM(0x00, dest.Reg(), src.Reg())
+func (b *Builder) EmitAddMemReg(src, dest Register, displacement int32) {
+	b.EmitAddMemRegSize(Qword, src, dest, displacement)
+}
+
+func (b *Builder) EmitAddMemRegSize(size Size, src, dest Register, displacement int32) {
+	b.emitSizePrefixes(size, dest, src, true)
+	if size == Byte {
+		// 00 /r	ADD r/m8, r8
+		b.output = append(b.output, 0x00)
 	} else {
-		b.emitModRMWithDisplacement(src.Reg(), dest.Reg(), displacement)
+		// 01 /r	ADD r/m16, r16 / r/m32, r32 / r/m64, r64
+		b.output = append(b.output, 0x01)
 	}
+	b.emitModRMMem(src.Reg(), dest.Reg(), displacement)
 }
 
-func (b *Builder) EmitAddRegMem(src, dest Register, displacement uint32) {
+func (b *Builder) EmitAddRegMem(src, dest Register, displacement int32) {
 	// TODO: Why on earth are these around the other way than every other
 	// instruction variation??????? Seems to be the same for everything in
 	// this variation?
 	b.emitREX(true, src.IsExt(), false, dest.IsExt())
 	// REX.W + 03 /r	ADD r64, r/m64
 	b.output = append(b.output, 0x03)
-	if displacement == 0 {
-		b.emitModRM(0x00, src.Reg(), dest.Reg())
-	} else {
-		b.emitModRMWithDisplacement(dest.Reg(), src.Reg(), displacement)
-	}
+	b.emitModRMMem(dest.Reg(), src.Reg(), displacement)
 }
 
-// Sub instruction
-func (b *Builder) EmitSubRegImm(src Register, imm uint32) {
+func (b *Builder) EmitAddMemImm(src Register, displacement int32, imm uint32) {
+	b.EmitAddMemImmSize(Qword, src, displacement, imm)
+}
 
-	b.emitREX(true, false, false, src.IsExt())
-	// NOTE: src == RAX and imm == 32-bit, then special case
-	if src == RAX && imm >= 128 {
-		// REX.W + 2D id	SUB RAX, imm32
-		b.output = append(b.output, 0x2d)
-	} else {
-		if imm < 128 {
-			// REX.W + 83 /5 ib	SUB r/m64, imm8
-			b.output = append(b.output, 0x83)
-			b.emitModRM(0x03, 0x05, src.Reg())
-		} else {
-			// REX.W + 81 /5 id	SUB r/m64, imm32
-			b.output = append(b.output, 0x81)
-			b.emitModRM(0x03, 0x05, src.Reg())
-		}
+func (b *Builder) EmitAddMemImmSize(size Size, src Register, displacement int32, imm uint32) {
+	b.Emit(Instr{Op: OpAdd, Size: size, Dst: Mem(src, displacement), Src: Imm(imm)})
+}
+
+// emitArithMemImm emits the arithmetic instruction selected by the
+// opcode extension ext (eg: 0 for add, 5 for sub) with a memory
+// destination and an immediate source. The immediate is sign
+// extended to size, so for Qword it has to be less than 1<<31.
+func (b *Builder) emitArithMemImm(size Size, ext byte, src Register, displacement int32, imm uint32) {
+	b.emitSizePrefixes(size, RegNull, src, false)
+	if size == Byte {
+		// 80 /ext ib	OP r/m8, imm8
+		b.output = append(b.output, 0x80)
+		b.emitModRMWithDisplacement(src.Reg(), ext, displacement)
+		b.output = append(b.output, uint8(imm))
+		return
 	}
-	// TODO: This is very similar to the displacement checking if
-	// imm8 or imm32, maybe refactor if possible?
-	if imm >= 128 {
-		// TODO: Move to function
-		buf := make([]byte, 4)
-		binary.LittleEndian.PutUint32(buf, imm)
-		b.output = append(b.output, buf...)
-	} else {
+	if imm < 128 {
+		// 83 /ext ib	OP r/m16, r/m32 or r/m64, imm8
+		b.output = append(b.output, 0x83)
+		b.emitModRMWithDisplacement(src.Reg(), ext, displacement)
 		b.output = append(b.output, uint8(imm))
+		return
 	}
+	// 81 /ext iw or id	OP r/m16, imm16 / r/m32, imm32 / r/m64, imm32
+	b.output = append(b.output, 0x81)
+	b.emitModRMWithDisplacement(src.Reg(), ext, displacement)
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, imm)
+	if size == Word {
+		buf = buf[:2]
+	}
+	b.output = append(b.output, buf...)
+}
+
+// Sub instruction
+func (b *Builder) EmitSubRegImm(src Register, imm uint32) {
+	b.EmitSubRegImmSize(Qword, src, imm)
+}
+
+// EmitSubRegImmSize emits a sub of imm from the low size bytes of src.
+// The immediate is sign extended for Qword.
+func (b *Builder) EmitSubRegImmSize(size Size, src Register, imm uint32) {
+	b.Emit(Instr{Op: OpSub, Size: size, Dst: Reg(src), Src: Imm(imm)})
 }
 
 func (b *Builder) EmitSubRegReg(src, dest Register) {
@@ -365,52 +809,102 @@ func (b *Builder) EmitSubRegReg(src, dest Register) {
 	b.emitModRM(0x3, dest.Reg(), src.Reg())
 }
 
-func (b *Builder) EmitSubMemReg(src, dest Register, displacement uint32) {
-	b.emitREX(true, dest.IsExt(), false, src.IsExt())
-	// REX.W + 29 /r	SUB r/m64, r64
-	b.output = append(b.output, 0x29)
-	if displacement == 0 {
-		b.emitModRM(0x00, dest.Reg(), src.Reg())
+func (b *Builder) EmitSubMemReg(src, dest Register, displacement int32) {
+	b.EmitSubMemRegSize(Qword, src, dest, displacement)
+}
+
+func (b *Builder) EmitSubMemRegSize(size Size, src, dest Register, displacement int32) {
+	b.emitSizePrefixes(size, dest, src, true)
+	if size == Byte {
+		// 28 /r	SUB r/m8, r8
+		b.output = append(b.output, 0x28)
 	} else {
-		b.emitModRMWithDisplacement(src.Reg(), dest.Reg(), displacement)
+		// 29 /r	SUB r/m16, r16 / r/m32, r32 / r/m64, r64
+		b.output = append(b.output, 0x29)
 	}
+	b.emitModRMMem(src.Reg(), dest.Reg(), displacement)
 }
 
-func (b *Builder) EmitSubRegMem(src, dest Register, displacement uint32) {
+func (b *Builder) EmitSubRegMem(src, dest Register, displacement int32) {
 	// TODO: Why on earth are these around the other way than every other
 	// instruction variation??????? Seems to be the same for everything in
 	// this variation?
 	b.emitREX(true, src.IsExt(), false, dest.IsExt())
 	// REX.W + 2B /r	SUB r64, r/m64
 	b.output = append(b.output, 0x2b)
-	if displacement == 0 {
-		b.emitModRM(0x00, src.Reg(), dest.Reg())
-	} else {
-		b.emitModRMWithDisplacement(dest.Reg(), src.Reg(), displacement)
+	b.emitModRMMem(dest.Reg(), src.Reg(), displacement)
+}
+
+func (b *Builder) EmitSubMemImm(src Register, displacement int32, imm uint32) {
+	b.EmitSubMemImmSize(Qword, src, displacement, imm)
+}
+
+func (b *Builder) EmitSubMemImmSize(size Size, src Register, displacement int32, imm uint32) {
+	b.Emit(Instr{Op: OpSub, Size: size, Dst: Mem(src, displacement), Src: Imm(imm)})
+}
+
+// Imul instruction
+func (b *Builder) EmitImulRegRegImm(src, dest Register, imm int32) {
+	// src = dest * imm
+	b.emitREX(true, src.IsExt(), false, dest.IsExt())
+	if imm >= -128 && imm <= 127 {
+		// REX.W + 6B /r ib	IMUL r64, r/m64, imm8
+		b.output = append(b.output, 0x6b)
+		b.emitModRM(0x03, src.Reg(), dest.Reg())
+		b.output = append(b.output, byte(imm))
+		return
 	}
+	// REX.W + 69 /r id	IMUL r64, r/m64, imm32
+	b.output = append(b.output, 0x69)
+	b.emitModRM(0x03, src.Reg(), dest.Reg())
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, uint32(imm))
+	b.output = append(b.output, buf...)
+}
+
+// Div instruction
+func (b *Builder) EmitDivReg(src Register) {
+	// REX.W + F7 /6	DIV r/m64, unsigned divide RDX:RAX by src,
+	// with the quotient in RAX and the remainder in RDX.
+	b.emitREX(true, false, false, src.IsExt())
+	b.output = append(b.output, 0xf7)
+	b.emitModRM(0x03, 0x06, src.Reg())
 }
 
 // Cmp instruction
 func (b *Builder) EmitCmpMemImm(src Register, imm uint32) {
-	b.emitREX(true, false, false, src.IsExt())
-	if imm < 128 {
-		// REX.W + 83 /7 ib	   CMP r/m64, imm8
+	b.EmitCmpMemImmSize(Qword, src, 0, imm)
+}
+
+func (b *Builder) EmitCmpMemImmSize(size Size, src Register, displacement int32, imm uint32) {
+	b.Emit(Instr{Op: OpCmp, Size: size, Dst: Mem(src, displacement), Src: Imm(imm)})
+}
+
+func (b *Builder) encodeCmpMemImm(size Size, src Register, displacement int32, imm uint32) {
+	b.emitSizePrefixes(size, RegNull, src, false)
+	if size == Byte {
+		// 80 /7 ib	CMP r/m8, imm8
+		b.output = append(b.output, 0x80)
+	} else if imm < 128 {
+		// 83 /7 ib	   CMP r/m16, r/m32 or r/m64, imm8
 		b.output = append(b.output, 0x83)
-		b.emitModRM(0x00, 0x07, src.Reg())
 	} else {
-		// REX.W + 81 /7 id	CMP r/m64, imm32
+		// 81 /7 iw or id	CMP r/m16, imm16 / r/m32, imm32 / r/m64, imm32
 		b.output = append(b.output, 0x81)
-		b.emitModRM(0x00, 0x07, src.Reg())
 	}
+	b.emitModRMMem(src.Reg(), 0x07, displacement)
 	// TODO: This is very similar to the displacement checking if
 	// imm8 or imm32, maybe refactor if possible?
-	if imm >= 128 {
+	if size == Byte || imm < 128 {
+		b.output = append(b.output, uint8(imm))
+	} else {
 		// TODO: Move to function
 		buf := make([]byte, 4)
 		binary.LittleEndian.PutUint32(buf, imm)
+		if size == Word {
+			buf = buf[:2]
+		}
 		b.output = append(b.output, buf...)
-	} else {
-		b.output = append(b.output, uint8(imm))
 	}
 }
 
@@ -450,31 +944,152 @@ func (b *Builder) EmitCmpRegReg(src, dest Register) {
 	b.emitModRM(0x3, dest.Reg(), src.Reg())
 }
 
-func (b *Builder) EmitCmpMemReg(src, dest Register, displacement uint32) {
+func (b *Builder) EmitCmpMemReg(src, dest Register, displacement int32) {
 	b.emitREX(true, dest.IsExt(), false, src.IsExt())
 	// REX.W + 39 /r	CMP r/m64,r64
 	b.output = append(b.output, 0x39)
-	if displacement == 0 {
-		b.emitModRM(0x00, dest.Reg(), src.Reg())
-	} else {
-		b.emitModRMWithDisplacement(src.Reg(), dest.Reg(), displacement)
-	}
+	b.emitModRMMem(src.Reg(), dest.Reg(), displacement)
 }
 
-func (b *Builder) EmitCmpRegMem(src, dest Register, displacement uint32) {
+func (b *Builder) EmitCmpRegMem(src, dest Register, displacement int32) {
 	// TODO: Why on earth are these around the other way than every other
 	// instruction variation??????? Seems to be the same for everything in
 	// this variation?
 	b.emitREX(true, src.IsExt(), false, dest.IsExt())
 	// REX.W + 3B /r	CMP r64, r/m64
 	b.output = append(b.output, 0x3b)
-	if displacement == 0 {
-		b.emitModRM(0x00, src.Reg(), dest.Reg())
+	b.emitModRMMem(dest.Reg(), src.Reg(), displacement)
+}
+
+// Bit instructions
+func (b *Builder) EmitAndRegImm(src Register, imm uint32) {
+	b.emitREX(true, false, false, src.IsExt())
+	if imm < 128 {
+		// REX.W + 83 /4 ib	AND r/m64, imm8
+		b.output = append(b.output, 0x83)
+		b.emitModRM(0x03, 0x04, src.Reg())
+		b.output = append(b.output, uint8(imm))
+		return
+	}
+	// REX.W + 81 /4 id	AND r/m64, imm32
+	b.output = append(b.output, 0x81)
+	b.emitModRM(0x03, 0x04, src.Reg())
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint32(buf, imm)
+	b.output = append(b.output, buf...)
+}
+
+func (b *Builder) EmitAndRegReg(src, dest Register) {
+	// REX.W + 21 /r	AND r/m64, r64
+	b.emitREX(true, dest.IsExt(), false, src.IsExt())
+	b.output = append(b.output, 0x21)
+	b.emitModRM(0x03, dest.Reg(), src.Reg())
+}
+
+func (b *Builder) EmitRolRegCl(src Register) {
+	// REX.W + D3 /0	ROL r/m64, CL
+	b.emitREX(true, false, false, src.IsExt())
+	b.output = append(b.output, 0xd3)
+	b.emitModRM(0x03, 0x00, src.Reg())
+}
+
+func (b *Builder) EmitShlRegCl(src Register) {
+	// REX.W + D3 /4	SHL r/m64, CL
+	b.emitREX(true, false, false, src.IsExt())
+	b.output = append(b.output, 0xd3)
+	b.emitModRM(0x03, 0x04, src.Reg())
+}
+
+func (b *Builder) EmitShrRegCl(src Register) {
+	// REX.W + D3 /5	SHR r/m64, CL
+	b.emitREX(true, false, false, src.IsExt())
+	b.output = append(b.output, 0xd3)
+	b.emitModRM(0x03, 0x05, src.Reg())
+}
+
+func (b *Builder) EmitTestRegReg(src, dest Register) {
+	b.EmitTestRegRegSize(Qword, src, dest)
+}
+
+// EmitTestRegRegSize emits a test of the low size bytes of src against
+// the low size bytes of dest.
+func (b *Builder) EmitTestRegRegSize(size Size, src, dest Register) {
+	b.Emit(Instr{Op: OpTest, Size: size, Dst: Reg(src), Src: Reg(dest)})
+}
+
+func (b *Builder) encodeTestRegReg(size Size, src, dest Register) {
+	b.emitRegSizePrefixes(size, dest, src)
+	if size == Byte {
+		// 84 /r	TEST r/m8, r8
+		b.output = append(b.output, 0x84)
 	} else {
-		b.emitModRMWithDisplacement(dest.Reg(), src.Reg(), displacement)
+		// 85 /r	TEST r/m16, r16 / r/m32, r32 / r/m64, r64
+		b.output = append(b.output, 0x85)
+	}
+	b.emitModRM(0x03, dest.Reg(), src.Reg())
+}
+
+// EmitBsfRegReg emits src = the index of the lowest set bit in dest.
+func (b *Builder) EmitBsfRegReg(src, dest Register) {
+	// REX.W + 0F BC /r	BSF r64, r/m64
+	b.emitREX(true, src.IsExt(), false, dest.IsExt())
+	b.output = append(b.output, 0x0f, 0xbc)
+	b.emitModRM(0x03, src.Reg(), dest.Reg())
+}
+
+// EmitBsrRegReg emits src = the index of the highest set bit in dest.
+func (b *Builder) EmitBsrRegReg(src, dest Register) {
+	// REX.W + 0F BD /r	BSR r64, r/m64
+	b.emitREX(true, src.IsExt(), false, dest.IsExt())
+	b.output = append(b.output, 0x0f, 0xbd)
+	b.emitModRM(0x03, src.Reg(), dest.Reg())
+}
+
+// SSE2 instructions, which all start with the 66 prefix followed by
+// an optional REX prefix.
+func (b *Builder) emitSSE2Prefixes(reg, rm int8) {
+	b.output = append(b.output, 0x66)
+	if reg&8 == 8 || rm&8 == 8 {
+		b.emitREX(false, reg&8 == 8, false, rm&8 == 8)
 	}
 }
 
+func (b *Builder) EmitPxor(src, dest XMMRegister) {
+	// 66 0F EF /r	PXOR xmm1, xmm2/m128
+	b.emitSSE2Prefixes(int8(src), int8(dest))
+	b.output = append(b.output, 0x0f, 0xef)
+	b.emitModRM(0x03, src.Reg(), dest.Reg())
+}
+
+// EmitMovdqaRegMem emits a load of the 16 bytes at dest plus
+// displacement, which must be 16 byte aligned.
+func (b *Builder) EmitMovdqaRegMem(src XMMRegister, dest Register, displacement int32) {
+	// 66 0F 6F /r	MOVDQA xmm1, xmm2/m128
+	b.emitSSE2Prefixes(int8(src), int8(dest))
+	b.output = append(b.output, 0x0f, 0x6f)
+	b.emitModRMWithDisplacement(dest.Reg(), src.Reg(), displacement)
+}
+
+func (b *Builder) EmitPcmpeqb(src, dest XMMRegister) {
+	// 66 0F 74 /r	PCMPEQB xmm1, xmm2/m128
+	b.emitSSE2Prefixes(int8(src), int8(dest))
+	b.output = append(b.output, 0x0f, 0x74)
+	b.emitModRM(0x03, src.Reg(), dest.Reg())
+}
+
+// EmitPmovmskb emits src = a mask of the top bit of each byte in dest.
+func (b *Builder) EmitPmovmskb(src Register, dest XMMRegister) {
+	// 66 0F D7 /r	PMOVMSKB r32, xmm
+	b.emitSSE2Prefixes(int8(src), int8(dest))
+	b.output = append(b.output, 0x0f, 0xd7)
+	b.emitModRM(0x03, src.Reg(), dest.Reg())
+}
+
+func (b *Builder) EmitStosb() {
+	// AA	STOSB, store AL at [RDI] and increment RDI.
+	b.output = append(b.output, 0xaa)
+}
+
 func (b *Builder) EmitRet() {
 	b.output = append(b.output, 0xc3)
 }
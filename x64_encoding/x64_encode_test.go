@@ -3,7 +3,10 @@ package x64_encoding
 import (
 	"bytes"
 	"encoding/hex"
+	"reflect"
 	"testing"
+
+	"github.com/vishen/go-brainfunk/dwarf"
 )
 
 func TestGeneration(t *testing.T) {
@@ -17,10 +20,119 @@ func TestGeneration(t *testing.T) {
 			0:  cd 80                   int    0x80
 		*/
 		{"int 0x80", func(b *Builder) { b.EmitInt(0x80) }, []byte{0xcd, 0x80}},
+		/*
+			0:  0f 05                   syscall
+		*/
+		{"syscall", func(b *Builder) { b.EmitSyscall() }, []byte{0x0f, 0x05}},
+		/*
+			0:  aa                      stos   BYTE PTR es:[rdi],al
+		*/
+		{"stosb", func(b *Builder) { b.EmitStosb() }, []byte{0xaa}},
+		/*
+			0:  48 f7 f1                div    rcx
+			3:  49 f7 f7                div    r15
+		*/
+		/*
+			0:  48 0f b6 50 00          movzx  rdx,BYTE PTR [rax+0x0]
+			5:  48 0f b7 50 08          movzx  rdx,WORD PTR [rax+0x8]
+			a:  4c 0f b6 a8 81 00 00 00 movzx  r13,BYTE PTR [rax+0x81]
+			12: 8b 50 04                mov    edx,DWORD PTR [rax+0x4]
+		*/
+		{"movzx rdx, byte [rax]", func(b *Builder) { b.EmitMovzxRegMemSize(Byte, RDX, RAX, 0) }, []byte{0x48, 0x0f, 0xb6, 0x50, 0x00}},
+		{"movzx rdx, word [rax+0x08]", func(b *Builder) { b.EmitMovzxRegMemSize(Word, RDX, RAX, 0x08) }, []byte{0x48, 0x0f, 0xb7, 0x50, 0x08}},
+		{"movzx r13, byte [rax+0x81]", func(b *Builder) { b.EmitMovzxRegMemSize(Byte, R13, RAX, 0x81) }, []byte{0x4c, 0x0f, 0xb6, 0xa8, 0x81, 0x00, 0x00, 0x00}},
+		{"mov edx, dword [rax+0x04]", func(b *Builder) { b.EmitMovzxRegMemSize(Dword, RDX, RAX, 0x04) }, []byte{0x8b, 0x50, 0x04}},
+		/*
+			0:  48 6b ca 03             imul   rcx,rdx,0x3
+			4:  48 6b ca fe             imul   rcx,rdx,0xfffffffffffffffe
+			8:  4c 69 ea 00 10 00 00    imul   r13,rdx,0x1000
+		*/
+		{"imul rcx, rdx, 3", func(b *Builder) { b.EmitImulRegRegImm(RCX, RDX, 3) }, []byte{0x48, 0x6b, 0xca, 0x03}},
+		{"imul rcx, rdx, -2", func(b *Builder) { b.EmitImulRegRegImm(RCX, RDX, -2) }, []byte{0x48, 0x6b, 0xca, 0xfe}},
+		{"imul r13, rdx, 0x1000", func(b *Builder) { b.EmitImulRegRegImm(R13, RDX, 0x1000) }, []byte{0x4c, 0x69, 0xea, 0x00, 0x10, 0x00, 0x00}},
+		/*
+			0:  48 83 e1 0f             and    rcx,0xf
+			4:  49 81 e1 80 00 00 00    and    r9,0x80
+			b:  48 d3 e2                shl    rdx,cl
+			e:  48 d3 ea                shr    rdx,cl
+			11: 49 d3 e9                shr    r9,cl
+			14: 48 85 d2                test   rdx,rdx
+			17: 49 85 c1                test   r9,rax
+			1a: 48 0f bc d2             bsf    rdx,rdx
+			1e: 49 0f bd d1             bsr    rdx,r9
+			22: 4c 21 c2                and    rdx,r8
+			25: 48 21 d1                and    rcx,rdx
+			28: 49 d3 c0                rol    r8,cl
+		*/
+		{"and rcx, 0x0f", func(b *Builder) { b.EmitAndRegImm(RCX, 0x0f) }, []byte{0x48, 0x83, 0xe1, 0x0f}},
+		{"and r9, 0x80", func(b *Builder) { b.EmitAndRegImm(R9, 0x80) }, []byte{0x49, 0x81, 0xe1, 0x80, 0x00, 0x00, 0x00}},
+		{"shl rdx, cl", func(b *Builder) { b.EmitShlRegCl(RDX) }, []byte{0x48, 0xd3, 0xe2}},
+		{"shr rdx, cl", func(b *Builder) { b.EmitShrRegCl(RDX) }, []byte{0x48, 0xd3, 0xea}},
+		{"shr r9, cl", func(b *Builder) { b.EmitShrRegCl(R9) }, []byte{0x49, 0xd3, 0xe9}},
+		{"test rdx, rdx", func(b *Builder) { b.EmitTestRegReg(RDX, RDX) }, []byte{0x48, 0x85, 0xd2}},
+		{"test r9, rax", func(b *Builder) { b.EmitTestRegReg(R9, RAX) }, []byte{0x49, 0x85, 0xc1}},
+		/*
+			0:  45 84 ed                test   r13b,r13b
+			3:  66 45 85 ed             test   r13w,r13w
+			7:  45 85 ed                test   r13d,r13d
+			a:  84 d2                   test   dl,dl
+		*/
+		{"test r13b, r13b", func(b *Builder) { b.EmitTestRegRegSize(Byte, R13, R13) }, []byte{0x45, 0x84, 0xed}},
+		{"test r13w, r13w", func(b *Builder) { b.EmitTestRegRegSize(Word, R13, R13) }, []byte{0x66, 0x45, 0x85, 0xed}},
+		{"test r13d, r13d", func(b *Builder) { b.EmitTestRegRegSize(Dword, R13, R13) }, []byte{0x45, 0x85, 0xed}},
+		{"test dl, dl", func(b *Builder) { b.EmitTestRegRegSize(Byte, RDX, RDX) }, []byte{0x84, 0xd2}},
+		{"test sil, sil", func(b *Builder) { b.EmitTestRegRegSize(Byte, RSI, RSI) }, []byte{0x40, 0x84, 0xf6}},
+		/*
+			0:  41 fe c5                inc    r13b
+			3:  66 41 ff cd             dec    r13w
+			7:  41 ff c5                inc    r13d
+			a:  40 fe ce                dec    sil
+			d:  41 80 c5 7f             add    r13b,0x7f
+			11: 66 41 81 ed 34 12       sub    r13w,0x1234
+			17: 41 81 c5 80 00 00 00    add    r13d,0x80
+			1e: 2d 00 10 00 00          sub    eax,0x1000
+			23: 40 80 c6 05             add    sil,0x5
+		*/
+		{"inc r13b", func(b *Builder) { b.EmitIncRegSize(Byte, R13) }, []byte{0x41, 0xfe, 0xc5}},
+		{"dec r13w", func(b *Builder) { b.EmitDecRegSize(Word, R13) }, []byte{0x66, 0x41, 0xff, 0xcd}},
+		{"inc r13d", func(b *Builder) { b.EmitIncRegSize(Dword, R13) }, []byte{0x41, 0xff, 0xc5}},
+		{"dec sil", func(b *Builder) { b.EmitDecRegSize(Byte, RSI) }, []byte{0x40, 0xfe, 0xce}},
+		{"add r13b, 0x7f", func(b *Builder) { b.EmitAddRegImmSize(Byte, R13, 0x7f) }, []byte{0x41, 0x80, 0xc5, 0x7f}},
+		{"sub r13w, 0x1234", func(b *Builder) { b.EmitSubRegImmSize(Word, R13, 0x1234) }, []byte{0x66, 0x41, 0x81, 0xed, 0x34, 0x12}},
+		{"add r13d, 0x80", func(b *Builder) { b.EmitAddRegImmSize(Dword, R13, 0x80) }, []byte{0x41, 0x81, 0xc5, 0x80, 0x00, 0x00, 0x00}},
+		{"sub eax, 0x1000", func(b *Builder) { b.EmitSubRegImmSize(Dword, RAX, 0x1000) }, []byte{0x2d, 0x00, 0x10, 0x00, 0x00}},
+		{"add sil, 5", func(b *Builder) { b.EmitAddRegImmSize(Byte, RSI, 5) }, []byte{0x40, 0x80, 0xc6, 0x05}},
+		{"bsf rdx, rdx", func(b *Builder) { b.EmitBsfRegReg(RDX, RDX) }, []byte{0x48, 0x0f, 0xbc, 0xd2}},
+		{"bsr rdx, r9", func(b *Builder) { b.EmitBsrRegReg(RDX, R9) }, []byte{0x49, 0x0f, 0xbd, 0xd1}},
+		{"and rdx, r8", func(b *Builder) { b.EmitAndRegReg(RDX, R8) }, []byte{0x4c, 0x21, 0xc2}},
+		{"and rcx, rdx", func(b *Builder) { b.EmitAndRegReg(RCX, RDX) }, []byte{0x48, 0x21, 0xd1}},
+		{"rol r8, cl", func(b *Builder) { b.EmitRolRegCl(R8) }, []byte{0x49, 0xd3, 0xc0}},
+		/*
+			0:  66 0f ef c9             pxor   xmm1,xmm1
+			4:  66 44 0f ef ca          pxor   xmm9,xmm2
+			9:  66 0f 6f 40 00          movdqa xmm0,XMMWORD PTR [rax+0x0]
+			e:  66 45 0f 6f 45 10       movdqa xmm8,XMMWORD PTR [r13+0x10]
+			14: 66 0f 74 c1             pcmpeqb xmm0,xmm1
+			18: 66 45 0f 74 c1          pcmpeqb xmm8,xmm9
+			1d: 66 0f d7 d0             pmovmskb edx,xmm0
+			21: 66 45 0f d7 c8          pmovmskb r9d,xmm8
+		*/
+		{"pxor xmm1, xmm1", func(b *Builder) { b.EmitPxor(XMM1, XMM1) }, []byte{0x66, 0x0f, 0xef, 0xc9}},
+		{"pxor xmm9, xmm2", func(b *Builder) { b.EmitPxor(XMM9, XMM2) }, []byte{0x66, 0x44, 0x0f, 0xef, 0xca}},
+		{"movdqa xmm0, [rax]", func(b *Builder) { b.EmitMovdqaRegMem(XMM0, RAX, 0) }, []byte{0x66, 0x0f, 0x6f, 0x40, 0x00}},
+		{"movdqa xmm8, [r13+0x10]", func(b *Builder) { b.EmitMovdqaRegMem(XMM8, R13, 0x10) }, []byte{0x66, 0x45, 0x0f, 0x6f, 0x45, 0x10}},
+		{"pcmpeqb xmm0, xmm1", func(b *Builder) { b.EmitPcmpeqb(XMM0, XMM1) }, []byte{0x66, 0x0f, 0x74, 0xc1}},
+		{"pcmpeqb xmm8, xmm9", func(b *Builder) { b.EmitPcmpeqb(XMM8, XMM9) }, []byte{0x66, 0x45, 0x0f, 0x74, 0xc1}},
+		{"pmovmskb edx, xmm0", func(b *Builder) { b.EmitPmovmskb(RDX, XMM0) }, []byte{0x66, 0x0f, 0xd7, 0xd0}},
+		{"pmovmskb r9d, xmm8", func(b *Builder) { b.EmitPmovmskb(R9, XMM8) }, []byte{0x66, 0x45, 0x0f, 0xd7, 0xc8}},
+		{"div rcx", func(b *Builder) { b.EmitDivReg(RCX) }, []byte{0x48, 0xf7, 0xf1}},
+		{"div r15", func(b *Builder) { b.EmitDivReg(R15) }, []byte{0x49, 0xf7, 0xf7}},
 
 		// Mov text
 		{"mov rax, 0x01", func(b *Builder) { b.EmitMovRegImm(RAX, 0x01) }, []byte{0x48, 0xc7, 0xc0, 0x01, 0x00, 0x00, 0x00}},
 		{"mov r15, 0x15", func(b *Builder) { b.EmitMovRegImm(R15, 0x15) }, []byte{0x49, 0xc7, 0xc7, 0x15, 0x00, 0x00, 0x00}},
+		{"mov r12, 0x123456789", func(b *Builder) { b.EmitMovRegImm64(R12, 0x123456789) }, []byte{0x49, 0xbc, 0x89, 0x67, 0x45, 0x23, 0x01, 0x00, 0x00, 0x00}},
+		{"mov rax, 0x01 (imm64)", func(b *Builder) { b.EmitMovRegImm64(RAX, 0x01) }, []byte{0x48, 0xb8, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
 		{"mov rax, rbx", func(b *Builder) { b.EmitMovRegReg(RAX, RBX) }, []byte{0x48, 0x89, 0xd8}},
 		{"mov rax, r13", func(b *Builder) { b.EmitMovRegReg(RAX, R13) }, []byte{0x4c, 0x89, 0xe8}},
 		{"mov r13, rbx", func(b *Builder) { b.EmitMovRegReg(R13, RBX) }, []byte{0x49, 0x89, 0xdd}},
@@ -28,12 +140,36 @@ func TestGeneration(t *testing.T) {
 		{"mov qword [r13], r14", func(b *Builder) { b.EmitMovMemReg(R13, R14, 0) }, []byte{0x4d, 0x89, 0x75, 0x00}},
 		{"mov qword [r13 + 0x04], r14", func(b *Builder) { b.EmitMovMemReg(R13, R14, 0x04) }, []byte{0x4d, 0x89, 0x75, 0x04}},
 		{"mov qword [r13 + 0x80], r14", func(b *Builder) { b.EmitMovMemReg(R13, R14, 0x80) }, []byte{0x4d, 0x89, 0xb5, 0x80, 0x00, 0x00, 0x00}},
+		/*
+			0:  48 c7 40 10 00 00 00 00 mov    QWORD PTR [rax+0x10],0x0
+			8:  c6 40 10 ff             mov    BYTE PTR [rax+0x10],0xff
+			c:  66 c7 40 10 34 12       mov    WORD PTR [rax+0x10],0x1234
+			12: 41 c7 85 81 00 00 00 78 56 34 12
+			                            mov    DWORD PTR [r13+0x81],0x12345678
+		*/
+		{"mov qword [rax+0x10], 0", func(b *Builder) { b.EmitMovMemImm(RAX, 0x10, 0) }, []byte{0x48, 0xc7, 0x40, 0x10, 0x00, 0x00, 0x00, 0x00}},
+		{"mov byte [rax+0x10], 0xff", func(b *Builder) { b.EmitMovMemImmSize(Byte, RAX, 0x10, 0xff) }, []byte{0xc6, 0x40, 0x10, 0xff}},
+		{"mov word [rax+0x10], 0x1234", func(b *Builder) { b.EmitMovMemImmSize(Word, RAX, 0x10, 0x1234) }, []byte{0x66, 0xc7, 0x40, 0x10, 0x34, 0x12}},
+		{"mov dword [r13+0x81], 0x12345678", func(b *Builder) { b.EmitMovMemImmSize(Dword, R13, 0x81, 0x12345678) }, []byte{0x41, 0xc7, 0x85, 0x81, 0x00, 0x00, 0x00, 0x78, 0x56, 0x34, 0x12}},
 		{"mov r13, qword [r14]", func(b *Builder) { b.EmitMovRegMem(R13, R14, 0) }, []byte{0x4d, 0x8b, 0x2e}},
 		{"mov r13, qword [r14 + 0x05]", func(b *Builder) { b.EmitMovRegMem(R13, R14, 0x05) }, []byte{0x4d, 0x8b, 0x6e, 0x05}},
 		{"mov r13, qword [r14 + 0x81]", func(b *Builder) { b.EmitMovRegMem(R13, R14, 0x81) }, []byte{0x4d, 0x8b, 0xae, 0x81, 0x00, 0x00, 0x00}},
 		{"mov r13, qword [rax]", func(b *Builder) { b.EmitMovRegMem(R13, RAX, 0x00) }, []byte{0x4c, 0x8b, 0x28}},
 		{"mov r13, qword [rbx]", func(b *Builder) { b.EmitMovRegMem(R13, RBX, 0x00) }, []byte{0x4c, 0x8b, 0x2b}},
 		{"mov r13, qword [rbx+0x81]", func(b *Builder) { b.EmitMovRegMem(R13, RBX, 0x81) }, []byte{0x4c, 0x8b, 0xab, 0x81, 0x00, 0x00, 0x00}},
+		/*
+			0:  49 8b 55 00             mov    rdx,QWORD PTR [r13+0x0]
+			4:  48 8b 55 00             mov    rdx,QWORD PTR [rbp+0x0]
+			8:  41 8a 14 24             mov    dl,BYTE PTR [r12]
+			c:  48 89 44 24 08          mov    QWORD PTR [rsp+0x8],rax
+			11: 41 fe 44 24 00          inc    BYTE PTR [r12+0x0]
+		*/
+		// RBP and R13 need a displacement, RSP and R12 need a SIB byte.
+		{"mov rdx, qword [r13]", func(b *Builder) { b.EmitMovRegMemSize(Qword, RDX, R13, 0) }, []byte{0x49, 0x8b, 0x55, 0x00}},
+		{"mov rdx, qword [rbp]", func(b *Builder) { b.EmitMovRegMemSize(Qword, RDX, RBP, 0) }, []byte{0x48, 0x8b, 0x55, 0x00}},
+		{"mov dl, byte [r12]", func(b *Builder) { b.EmitMovRegMemSize(Byte, RDX, R12, 0) }, []byte{0x41, 0x8a, 0x14, 0x24}},
+		{"mov qword [rsp+0x08], rax", func(b *Builder) { b.EmitMovMemReg(RSP, RAX, 0x08) }, []byte{0x48, 0x89, 0x44, 0x24, 0x08}},
+		{"inc byte [r12]", func(b *Builder) { b.EmitIncMemSize(Byte, R12, 0) }, []byte{0x41, 0xfe, 0x44, 0x24, 0x00}},
 
 		/*
 			0:  48 ff c0                inc    rax
@@ -47,6 +183,8 @@ func TestGeneration(t *testing.T) {
 		{"inc [r13]", func(b *Builder) { b.EmitIncMem(R13, 0) }, []byte{0x49, 0xff, 0x45, 0x00}},
 		{"inc [r13+0x04]", func(b *Builder) { b.EmitIncMem(R13, 4) }, []byte{0x49, 0xff, 0x45, 0x04}},
 		{"inc [r13+0x81]", func(b *Builder) { b.EmitIncMem(R13, 0x81) }, []byte{0x49, 0xff, 0x85, 0x81, 0x00, 0x00, 0x00}},
+		{"inc [r13-0x80]", func(b *Builder) { b.EmitIncMem(R13, -0x80) }, []byte{0x49, 0xff, 0x45, 0x80}},
+		{"inc [r13-0x81]", func(b *Builder) { b.EmitIncMem(R13, -0x81) }, []byte{0x49, 0xff, 0x85, 0x7f, 0xff, 0xff, 0xff}},
 
 		/*
 			0:  48 ff c8                dec    rax
@@ -97,6 +235,39 @@ func TestGeneration(t *testing.T) {
 		{"add qword [r8+0x04], rax", func(b *Builder) { b.EmitAddMemReg(R8, RAX, 0x04) }, []byte{0x49, 0x01, 0x40, 0x04}},
 		{"add qword [r8+0x81], rax", func(b *Builder) { b.EmitAddMemReg(R8, RAX, 0x81) }, []byte{0x49, 0x01, 0x80, 0x81, 0x00, 0x00, 0x00}},
 		{"add qword [r8+0x81], rbx", func(b *Builder) { b.EmitAddMemReg(R8, RBX, 0x81) }, []byte{0x49, 0x01, 0x98, 0x81, 0x00, 0x00, 0x00}},
+		/*
+			0:  00 48 01                add    BYTE PTR [rax+0x1],cl
+			3:  66 01 48 02             add    WORD PTR [rax+0x2],cx
+			7:  01 48 04                add    DWORD PTR [rax+0x4],ecx
+			a:  48 01 48 08             add    QWORD PTR [rax+0x8],rcx
+			e:  40 00 70 01             add    BYTE PTR [rax+0x1],sil
+		*/
+		{"add byte [rax+0x01], cl", func(b *Builder) { b.EmitAddMemRegSize(Byte, RAX, RCX, 0x01) }, []byte{0x00, 0x48, 0x01}},
+		{"add word [rax+0x02], cx", func(b *Builder) { b.EmitAddMemRegSize(Word, RAX, RCX, 0x02) }, []byte{0x66, 0x01, 0x48, 0x02}},
+		{"add dword [rax+0x04], ecx", func(b *Builder) { b.EmitAddMemRegSize(Dword, RAX, RCX, 0x04) }, []byte{0x01, 0x48, 0x04}},
+		{"add qword [rax+0x08], rcx", func(b *Builder) { b.EmitAddMemRegSize(Qword, RAX, RCX, 0x08) }, []byte{0x48, 0x01, 0x48, 0x08}},
+		{"add byte [rax+0x01], sil", func(b *Builder) { b.EmitAddMemRegSize(Byte, RAX, RSI, 0x01) }, []byte{0x40, 0x00, 0x70, 0x01}},
+		/*
+			0:  49 01 55 00             add    QWORD PTR [r13+0x0],rdx
+			4:  41 00 14 24             add    BYTE PTR [r12],dl
+		*/
+		{"add qword [r13], rdx", func(b *Builder) { b.EmitAddMemRegSize(Qword, R13, RDX, 0) }, []byte{0x49, 0x01, 0x55, 0x00}},
+		{"add byte [r12], dl", func(b *Builder) { b.EmitAddMemRegSize(Byte, R12, RDX, 0) }, []byte{0x41, 0x00, 0x14, 0x24}},
+		/*
+			0:  48 83 40 00 05          add    QWORD PTR [rax+0x0],0x5
+			5:  48 81 40 00 80 00 00 00 add    QWORD PTR [rax+0x0],0x80
+			d:  49 81 85 81 00 00 00 45 23 01 00
+			                            add    QWORD PTR [r13+0x81],0x12345
+			18: 80 40 00 c8             add    BYTE PTR [rax+0x0],0xc8
+			1c: 66 81 40 00 34 12       add    WORD PTR [rax+0x0],0x1234
+			22: 83 40 00 7f             add    DWORD PTR [rax+0x0],0x7f
+		*/
+		{"add qword [rax], 0x05", func(b *Builder) { b.EmitAddMemImm(RAX, 0, 0x05) }, []byte{0x48, 0x83, 0x40, 0x00, 0x05}},
+		{"add qword [rax], 0x80", func(b *Builder) { b.EmitAddMemImm(RAX, 0, 0x80) }, []byte{0x48, 0x81, 0x40, 0x00, 0x80, 0x00, 0x00, 0x00}},
+		{"add qword [r13+0x81], 0x12345", func(b *Builder) { b.EmitAddMemImm(R13, 0x81, 0x12345) }, []byte{0x49, 0x81, 0x85, 0x81, 0x00, 0x00, 0x00, 0x45, 0x23, 0x01, 0x00}},
+		{"add byte [rax], 0xc8", func(b *Builder) { b.EmitAddMemImmSize(Byte, RAX, 0, 0xc8) }, []byte{0x80, 0x40, 0x00, 0xc8}},
+		{"add word [rax], 0x1234", func(b *Builder) { b.EmitAddMemImmSize(Word, RAX, 0, 0x1234) }, []byte{0x66, 0x81, 0x40, 0x00, 0x34, 0x12}},
+		{"add dword [rax], 0x7f", func(b *Builder) { b.EmitAddMemImmSize(Dword, RAX, 0, 0x7f) }, []byte{0x83, 0x40, 0x00, 0x7f}},
 
 		/*
 			0:  48 83 e8 01             sub    rax,0x1
@@ -132,6 +303,28 @@ func TestGeneration(t *testing.T) {
 		{"sub r11, qword [rbx]", func(b *Builder) { b.EmitSubRegMem(R11, RBX, 0) }, []byte{0x4c, 0x2b, 0x1b}},
 		{"sub r11, qword [rbx + 0x04]", func(b *Builder) { b.EmitSubRegMem(R11, RBX, 4) }, []byte{0x4c, 0x2b, 0x5b, 0x04}},
 		{"sub r11, qword [rbx + 0x81]", func(b *Builder) { b.EmitSubRegMem(R11, RBX, 0x81) }, []byte{0x4c, 0x2b, 0x9b, 0x81, 0x00, 0x00, 0x00}},
+		/*
+			0:  28 50 01                sub    BYTE PTR [rax+0x1],dl
+			3:  4c 29 68 08             sub    QWORD PTR [rax+0x8],r13
+		*/
+		{"sub byte [rax+0x01], dl", func(b *Builder) { b.EmitSubMemRegSize(Byte, RAX, RDX, 0x01) }, []byte{0x28, 0x50, 0x01}},
+		{"sub qword [rax+0x08], r13", func(b *Builder) { b.EmitSubMemRegSize(Qword, RAX, R13, 0x08) }, []byte{0x4c, 0x29, 0x68, 0x08}},
+		/*
+			0:  49 29 55 00             sub    QWORD PTR [r13+0x0],rdx
+			4:  49 29 14 24             sub    QWORD PTR [r12],rdx
+		*/
+		{"sub qword [r13], rdx", func(b *Builder) { b.EmitSubMemRegSize(Qword, R13, RDX, 0) }, []byte{0x49, 0x29, 0x55, 0x00}},
+		{"sub qword [r12], rdx", func(b *Builder) { b.EmitSubMemRegSize(Qword, R12, RDX, 0) }, []byte{0x49, 0x29, 0x14, 0x24}},
+		/*
+			0:  48 83 68 00 05          sub    QWORD PTR [rax+0x0],0x5
+			5:  80 68 00 03             sub    BYTE PTR [rax+0x0],0x3
+			9:  66 81 68 04 00 01       sub    WORD PTR [rax+0x4],0x100
+			f:  81 68 00 00 00 01 00    sub    DWORD PTR [rax+0x0],0x10000
+		*/
+		{"sub qword [rax], 0x05", func(b *Builder) { b.EmitSubMemImm(RAX, 0, 0x05) }, []byte{0x48, 0x83, 0x68, 0x00, 0x05}},
+		{"sub byte [rax], 0x03", func(b *Builder) { b.EmitSubMemImmSize(Byte, RAX, 0, 0x03) }, []byte{0x80, 0x68, 0x00, 0x03}},
+		{"sub word [rax+0x04], 0x100", func(b *Builder) { b.EmitSubMemImmSize(Word, RAX, 0x04, 0x100) }, []byte{0x66, 0x81, 0x68, 0x04, 0x00, 0x01}},
+		{"sub dword [rax], 0x10000", func(b *Builder) { b.EmitSubMemImmSize(Dword, RAX, 0, 0x10000) }, []byte{0x81, 0x68, 0x00, 0x00, 0x00, 0x01, 0x00}},
 		{"sub qword [r8], rax", func(b *Builder) { b.EmitSubMemReg(R8, RAX, 0) }, []byte{0x49, 0x29, 0x00}},
 		{"sub qword [r8+0x04], rax", func(b *Builder) { b.EmitSubMemReg(R8, RAX, 0x04) }, []byte{0x49, 0x29, 0x40, 0x04}},
 		{"sub qword [r8+0x81], rax", func(b *Builder) { b.EmitSubMemReg(R8, RAX, 0x81) }, []byte{0x49, 0x29, 0x80, 0x81, 0x00, 0x00, 0x00}},
@@ -176,6 +369,73 @@ func TestGeneration(t *testing.T) {
 		{"cmp qword [r8+0x81], rax", func(b *Builder) { b.EmitCmpMemReg(R8, RAX, 0x81) }, []byte{0x49, 0x39, 0x80, 0x81, 0x00, 0x00, 0x00}},
 		{"cmp qword [r8+0x81], rbx", func(b *Builder) { b.EmitCmpMemReg(R8, RBX, 0x81) }, []byte{0x49, 0x39, 0x98, 0x81, 0x00, 0x00, 0x00}},
 		{"cmp qword [rax], 0x00", func(b *Builder) { b.EmitCmpMemImm(RAX, 0) }, []byte{0x48, 0x83, 0x38, 0x00}},
+
+		/*
+			0:  fe 40 00                inc    BYTE PTR [rax+0x0]
+			3:  66 ff 40 00             inc    WORD PTR [rax+0x0]
+			7:  ff 40 00                inc    DWORD PTR [rax+0x0]
+			a:  41 fe 45 04             inc    BYTE PTR [r13+0x4]
+			e:  fe 48 00                dec    BYTE PTR [rax+0x0]
+			11: 66 ff 48 00             dec    WORD PTR [rax+0x0]
+			15: ff 48 00                dec    DWORD PTR [rax+0x0]
+			18: 41 fe 4d 04             dec    BYTE PTR [r13+0x4]
+		*/
+		{"inc byte [rax]", func(b *Builder) { b.EmitIncMemSize(Byte, RAX, 0) }, []byte{0xfe, 0x40, 0x00}},
+		{"inc word [rax]", func(b *Builder) { b.EmitIncMemSize(Word, RAX, 0) }, []byte{0x66, 0xff, 0x40, 0x00}},
+		{"inc dword [rax]", func(b *Builder) { b.EmitIncMemSize(Dword, RAX, 0) }, []byte{0xff, 0x40, 0x00}},
+		{"inc byte [r13+0x04]", func(b *Builder) { b.EmitIncMemSize(Byte, R13, 4) }, []byte{0x41, 0xfe, 0x45, 0x04}},
+		{"dec byte [rax]", func(b *Builder) { b.EmitDecMemSize(Byte, RAX, 0) }, []byte{0xfe, 0x48, 0x00}},
+		{"dec word [rax]", func(b *Builder) { b.EmitDecMemSize(Word, RAX, 0) }, []byte{0x66, 0xff, 0x48, 0x00}},
+		{"dec dword [rax]", func(b *Builder) { b.EmitDecMemSize(Dword, RAX, 0) }, []byte{0xff, 0x48, 0x00}},
+		{"dec byte [r13+0x04]", func(b *Builder) { b.EmitDecMemSize(Byte, R13, 4) }, []byte{0x41, 0xfe, 0x4d, 0x04}},
+
+		/*
+			0:  80 38 00                cmp    BYTE PTR [rax],0x0
+			3:  66 83 38 00             cmp    WORD PTR [rax],0x0
+			7:  83 38 00                cmp    DWORD PTR [rax],0x0
+			a:  41 80 38 00             cmp    BYTE PTR [r8],0x0
+			e:  66 81 38 81 00          cmp    WORD PTR [rax],0x81
+			13: 81 38 81 00 00 00       cmp    DWORD PTR [rax],0x81
+		*/
+		{"cmp byte [rax], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Byte, RAX, 0, 0) }, []byte{0x80, 0x38, 0x00}},
+		{"cmp word [rax], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Word, RAX, 0, 0) }, []byte{0x66, 0x83, 0x38, 0x00}},
+		{"cmp dword [rax], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Dword, RAX, 0, 0) }, []byte{0x83, 0x38, 0x00}},
+		{"cmp byte [r8], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Byte, R8, 0, 0) }, []byte{0x41, 0x80, 0x38, 0x00}},
+		{"cmp word [rax], 0x81", func(b *Builder) { b.EmitCmpMemImmSize(Word, RAX, 0, 0x81) }, []byte{0x66, 0x81, 0x38, 0x81, 0x00}},
+		{"cmp dword [rax], 0x81", func(b *Builder) { b.EmitCmpMemImmSize(Dword, RAX, 0, 0x81) }, []byte{0x81, 0x38, 0x81, 0x00, 0x00, 0x00}},
+		/*
+			0:  80 78 ff 00             cmp    BYTE PTR [rax-0x1],0x0
+			4:  48 83 b8 00 ff ff ff 00 cmp    QWORD PTR [rax-0x100],0x0
+		*/
+		{"cmp byte [rax-0x01], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Byte, RAX, -1, 0) }, []byte{0x80, 0x78, 0xff, 0x00}},
+		{"cmp qword [rax-0x100], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Qword, RAX, -0x100, 0) }, []byte{0x48, 0x83, 0xb8, 0x00, 0xff, 0xff, 0xff, 0x00}},
+		/*
+			0:  41 80 7d 00 00          cmp    BYTE PTR [r13+0x0],0x0
+			5:  49 83 3c 24 00          cmp    QWORD PTR [r12],0x0
+			a:  49 83 7c 24 08 00       cmp    QWORD PTR [r12+0x8],0x0
+		*/
+		{"cmp byte [r13], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Byte, R13, 0, 0) }, []byte{0x41, 0x80, 0x7d, 0x00, 0x00}},
+		{"cmp qword [r12], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Qword, R12, 0, 0) }, []byte{0x49, 0x83, 0x3c, 0x24, 0x00}},
+		{"cmp qword [r12+0x08], 0x00", func(b *Builder) { b.EmitCmpMemImmSize(Qword, R12, 0x08, 0) }, []byte{0x49, 0x83, 0x7c, 0x24, 0x08, 0x00}},
+
+		/*
+			0:  41 88 56 00             mov    BYTE PTR [r14+0x0],dl
+			4:  66 41 89 56 00          mov    WORD PTR [r14+0x0],dx
+			9:  41 89 56 00             mov    DWORD PTR [r14+0x0],edx
+			d:  40 88 70 00             mov    BYTE PTR [rax+0x0],sil
+			11: 8a 00                   mov    al,BYTE PTR [rax]
+			13: 44 8a 2b                mov    r13b,BYTE PTR [rbx]
+			16: 66 8b 53 04             mov    dx,WORD PTR [rbx+0x4]
+			1a: 8b 13                   mov    edx,DWORD PTR [rbx]
+		*/
+		{"mov byte [r14], dl", func(b *Builder) { b.EmitMovMemRegSize(Byte, R14, RDX, 0) }, []byte{0x41, 0x88, 0x56, 0x00}},
+		{"mov word [r14], dx", func(b *Builder) { b.EmitMovMemRegSize(Word, R14, RDX, 0) }, []byte{0x66, 0x41, 0x89, 0x56, 0x00}},
+		{"mov dword [r14], edx", func(b *Builder) { b.EmitMovMemRegSize(Dword, R14, RDX, 0) }, []byte{0x41, 0x89, 0x56, 0x00}},
+		{"mov byte [rax], sil", func(b *Builder) { b.EmitMovMemRegSize(Byte, RAX, RSI, 0) }, []byte{0x40, 0x88, 0x70, 0x00}},
+		{"mov al, byte [rax]", func(b *Builder) { b.EmitMovRegMemSize(Byte, RAX, RAX, 0) }, []byte{0x8a, 0x00}},
+		{"mov r13b, byte [rbx]", func(b *Builder) { b.EmitMovRegMemSize(Byte, R13, RBX, 0) }, []byte{0x44, 0x8a, 0x2b}},
+		{"mov dx, word [rbx+0x04]", func(b *Builder) { b.EmitMovRegMemSize(Word, RDX, RBX, 4) }, []byte{0x66, 0x8b, 0x53, 0x04}},
+		{"mov edx, dword [rbx]", func(b *Builder) { b.EmitMovRegMemSize(Dword, RDX, RBX, 0) }, []byte{0x8b, 0x13}},
 	}
 
 	for _, ins := range instr {
@@ -189,6 +449,33 @@ func TestGeneration(t *testing.T) {
 	}
 }
 
+func TestLeaRegRip(t *testing.T) {
+	tests := []struct {
+		name     string
+		f        func(b *Builder)
+		expected []byte
+	}{
+		// The displacement is from the end of the 7 byte lea.
+		{"lea rsi, [rip-7]", func(b *Builder) { b.EmitLeaRegRip(RSI, b.TextAddr(0)) }, []byte{0x48, 0x8d, 0x35, 0xf9, 0xff, 0xff, 0xff}},
+		{"lea r13, [rip+0x100]", func(b *Builder) { b.EmitLeaRegRip(R13, b.TextAddr(7+0x100)) }, []byte{0x4c, 0x8d, 0x2d, 0x00, 0x01, 0x00, 0x00}},
+		// The .bss segment is the same distance from the text in a
+		// position independent executable.
+		{"lea rax, [rip+0x1fff11]", func(b *Builder) { b.EmitLeaRegRip(RAX, b.BssAdd(8)) }, []byte{0x48, 0x8d, 0x05, 0x11, 0xff, 0x1f, 0x00}},
+		{"lea rax, [rip+0x1fff11] (pie)", func(b *Builder) {
+			b.SetPIE(true)
+			b.EmitLeaRegRip(RAX, b.BssAdd(8))
+		}, []byte{0x48, 0x8d, 0x05, 0x11, 0xff, 0x1f, 0x00}},
+	}
+
+	for _, tt := range tests {
+		b := NewBuilder()
+		tt.f(b)
+		if !bytes.Equal(b.output, tt.expected) {
+			t.Errorf("%s: unexpected generated output %s, expected %s", tt.name, hexB(b.output), hexB(tt.expected))
+		}
+	}
+}
+
 func TestJne(t *testing.T) {
 	/*
 		0:  48 c7 c0 00 00 00 00    mov    rax,0x0
@@ -216,6 +503,57 @@ func TestJne(t *testing.T) {
 	}
 }
 
+func TestJccBack(t *testing.T) {
+	/*
+		0000000000000000 <loop1>:
+		0:  48 83 c0 02             add    rax,0x2
+		4:  48 39 d8                cmp    rax,rbx
+		7:  73 f7                   jae    0 <loop1>
+	*/
+	b := &Builder{}
+	b.EmitAddRegImm(RAX, 0x02)
+	b.EmitCmpRegReg(RAX, RBX)
+	if length := b.EmitJccBack(CondAE, 0); length != 2 {
+		t.Errorf("unexpected jump length %d, expected 2", length)
+	}
+
+	expectedOutput := []byte{
+		0x48, 0x83, 0xc0, 0x02,
+		0x48, 0x39, 0xd8,
+		0x73, 0xf7,
+	}
+	if !bytes.Equal(b.output, expectedOutput) {
+		t.Errorf("unexpected generated output %s, expected %s", b.hex(), hexB(expectedOutput))
+	}
+}
+
+func TestJneBackBoundary(t *testing.T) {
+	// A rel8 jump can reach 128 bytes back from the end of the
+	// jump, so 126 bytes before the jump is the furthest the short
+	// encoding reaches.
+	b := &Builder{}
+	for i := 0; i < 126; i++ {
+		b.EmitNop()
+	}
+	if length := b.EmitJneBack(0); length != 2 {
+		t.Errorf("unexpected jump length %d for 126 bytes, expected 2", length)
+	}
+	if !bytes.Equal(b.output[126:], []byte{0x75, 0x80}) {
+		t.Errorf("unexpected jump %s, expected 75 80", hexB(b.output[126:]))
+	}
+
+	b = &Builder{}
+	for i := 0; i < 127; i++ {
+		b.EmitNop()
+	}
+	if length := b.EmitJneBack(0); length != 6 {
+		t.Errorf("unexpected jump length %d for 127 bytes, expected 6", length)
+	}
+	if !bytes.Equal(b.output[127:], []byte{0x0f, 0x85, 0x7b, 0xff, 0xff, 0xff}) {
+		t.Errorf("unexpected jump %s, expected 0f 85 7b ff ff ff", hexB(b.output[127:]))
+	}
+}
+
 func TestJneLong(t *testing.T) {
 	/*
 		0:  48 c7 c0 01 00 00 00    mov    rax,0x1
@@ -308,7 +646,7 @@ func TestJumpForward(t *testing.T) {
 	b.EmitMovRegImm(RAX, 0x01)
 	b.EmitMovRegImm(RAX, 0x01)
 	b.EmitMovRegImm(RAX, 0x01)
-	b.CompleteJeq(addrID, b.CurrentOffset(), 2) // loop1:
+	b.CompleteJeq(addrID, b.CurrentOffset()) // loop1:
 	b.EmitMovRegImm(RAX, 0x02)
 
 	expectedOutput := []byte{
@@ -328,6 +666,53 @@ func TestJumpForward(t *testing.T) {
 	}
 }
 
+func TestJumpForwardLong(t *testing.T) {
+	// The long je is 6 bytes, the jump is relative to the end of it
+	// rather than the end of the short encoding.
+	b := &Builder{
+		addrIDToIndexInOutput: make(map[int]int),
+	}
+	addrID := b.EmitJeqNotYetDefined()
+	for i := 0; i < 200; i++ {
+		b.EmitNop()
+	}
+	b.CompleteJeq(addrID, b.CurrentOffset())
+
+	// 8 bytes for the je and its padding, less the 6 of the je.
+	expected := []byte{0x0f, 0x84, 0xca, 0x00, 0x00, 0x00}
+	if !bytes.Equal(b.output[:6], expected) {
+		t.Errorf("unexpected je %s, expected %s", hexB(b.output[:6]), hexB(expected))
+	}
+}
+
+func TestJccForward(t *testing.T) {
+	/*
+		0:  48 39 d8                cmp    rax,rbx
+		3:  0f 82 07 00 00 00       jb     10 <ok>
+		9:  48 c7 c0 01 00 00 00    mov    rax,0x1
+		0000000000000010 <ok>:
+		10: 48 c7 c0 02 00 00 00    mov    rax,0x2
+	*/
+	b := &Builder{
+		addrIDToIndexInOutput: make(map[int]int),
+	}
+	b.EmitCmpRegReg(RAX, RBX)
+	addrID := b.EmitJccNotYetDefined(CondB)
+	b.EmitMovRegImm(RAX, 0x01)
+	b.CompleteJcc(addrID, b.CurrentOffset())
+	b.EmitMovRegImm(RAX, 0x02)
+
+	expectedOutput := []byte{
+		0x48, 0x39, 0xd8,
+		0x0f, 0x82, 0x07, 0x00, 0x00, 0x00,
+		0x48, 0xc7, 0xc0, 0x01, 0x00, 0x00, 0x00,
+		0x48, 0xc7, 0xc0, 0x02, 0x00, 0x00, 0x00,
+	}
+	if !bytes.Equal(b.output, expectedOutput) {
+		t.Errorf("unexpected generated output %s, expected %s", b.hex(), hexB(expectedOutput))
+	}
+}
+
 func TestEmitCall(t *testing.T) {
 	/*
 		0:  48 c7 c0 01 00 00 00    mov    rax,0x1
@@ -358,6 +743,25 @@ func TestEmitCall(t *testing.T) {
 	}
 }
 
+func TestDataAdd(t *testing.T) {
+	b := NewBuilder()
+	start := b.elfB.DataStartAddr()
+	if addr := b.DataAdd(nil, 4); addr != start {
+		t.Errorf("unexpected address %#x, expected %#x", addr, start)
+	}
+	if addr := b.DataAdd([]byte{1, 2}, 8); addr != start+4 {
+		t.Errorf("unexpected address %#x, expected %#x", addr, start+4)
+	}
+	b.DataAdd(nil, 16)
+	// Only the data up to the last initialised byte is kept.
+	if expected := []byte{0, 0, 0, 0, 1, 2}; !bytes.Equal(b.data, expected) {
+		t.Errorf("unexpected data %v, expected %v", b.data, expected)
+	}
+	if b.currentDataSize != 28 {
+		t.Errorf("unexpected data size %d, expected 28", b.currentDataSize)
+	}
+}
+
 func hexB(b []byte) string {
 	return hex.EncodeToString(b)
 }
@@ -367,3 +771,36 @@ func builderOutput(f func(b *Builder)) []byte {
 	f(b)
 	return b.output
 }
+
+func TestSetSourcePos(t *testing.T) {
+	b := NewBuilder()
+	// Does nothing without debug information.
+	b.SetSourcePos(1, 1)
+	b.EmitNop()
+
+	b.Debug = &dwarf.Unit{}
+	b.SetSourcePos(1, 2)
+	b.EmitNop()
+	// The same position as the last one.
+	b.SetSourcePos(1, 2)
+	b.EmitNop()
+	// Nothing is emitted for 1:3, so 2:1 replaces it.
+	b.SetSourcePos(1, 3)
+	b.SetSourcePos(2, 1)
+	b.EmitNop()
+	// Nothing is emitted for 2:2 either, and without it the next
+	// position is the same as the last one.
+	b.SetSourcePos(2, 2)
+	b.SetSourcePos(2, 1)
+	b.EmitNop()
+	b.SetSourcePos(0, 0)
+
+	expected := []dwarf.Line{
+		{Addr: b.TextAddr(1), Line: 1, Column: 2},
+		{Addr: b.TextAddr(3), Line: 2, Column: 1},
+		{Addr: b.TextAddr(5), Line: 0, Column: 0},
+	}
+	if !reflect.DeepEqual(b.Debug.Lines, expected) {
+		t.Errorf("unexpected lines %+v, expected %+v", b.Debug.Lines, expected)
+	}
+}